@@ -160,6 +160,27 @@ type (
 		Err Node
 	}
 
+	DeferStmt struct {
+		NodeInfo
+		Call *CallExpr
+	}
+
+	GoStmt struct {
+		NodeInfo
+		Call *CallExpr
+	}
+
+	YieldStmt struct {
+		NodeInfo
+		Value Node
+	}
+
+	SendStmt struct {
+		NodeInfo
+		Chan  Node
+		Value Node
+	}
+
 	IfStmt struct {
 		NodeInfo
 		Init *Assignment
@@ -185,6 +206,30 @@ type (
 		Body Node
 	}
 
+	CaseClause struct {
+		NodeInfo
+		Values []Node // nil in the default clause
+		Body   *Block
+	}
+
+	SwitchStmt struct {
+		NodeInfo
+		Init  *Assignment
+		Tag   Node // nil in a tagless switch
+		Cases []*CaseClause
+	}
+
+	CommClause struct {
+		NodeInfo
+		Comm Node // send, receive or assignment of a receive, nil in the default clause
+		Body *Block
+	}
+
+	SelectStmt struct {
+		NodeInfo
+		Cases []*CommClause
+	}
+
 	RecoverBlock struct {
 		NodeInfo
 		Id    *Id
@@ -300,6 +345,22 @@ func (node *PanicStmt) Accept(v Visitor, data interface{}) {
 	v.VisitPanicStmt(node, data)
 }
 
+func (node *DeferStmt) Accept(v Visitor, data interface{}) {
+	v.VisitDeferStmt(node, data)
+}
+
+func (node *GoStmt) Accept(v Visitor, data interface{}) {
+	v.VisitGoStmt(node, data)
+}
+
+func (node *YieldStmt) Accept(v Visitor, data interface{}) {
+	v.VisitYieldStmt(node, data)
+}
+
+func (node *SendStmt) Accept(v Visitor, data interface{}) {
+	v.VisitSendStmt(node, data)
+}
+
 func (node *IfStmt) Accept(v Visitor, data interface{}) {
 	v.VisitIfStmt(node, data)
 }
@@ -312,6 +373,22 @@ func (node *ForStmt) Accept(v Visitor, data interface{}) {
 	v.VisitForStmt(node, data)
 }
 
+func (node *CaseClause) Accept(v Visitor, data interface{}) {
+	v.VisitCaseClause(node, data)
+}
+
+func (node *SwitchStmt) Accept(v Visitor, data interface{}) {
+	v.VisitSwitchStmt(node, data)
+}
+
+func (node *CommClause) Accept(v Visitor, data interface{}) {
+	v.VisitCommClause(node, data)
+}
+
+func (node *SelectStmt) Accept(v Visitor, data interface{}) {
+	v.VisitSelectStmt(node, data)
+}
+
 func (node *RecoverBlock) Accept(v Visitor, data interface{}) {
 	v.VisitRecoverBlock(node, data)
 }
@@ -326,10 +403,13 @@ func (node *Block) Accept(v Visitor, data interface{}) {
 
 // return true if the given node is a statement
 func IsStmt(node Node) bool {
-	switch node.(type) {
-	case *Assignment, *IfStmt, *ForStmt, *ForIteratorStmt,
-		*BranchStmt, *ReturnStmt, *Declaration:
+	switch n := node.(type) {
+	case *Assignment, *IfStmt, *ForStmt, *ForIteratorStmt, *SwitchStmt, *SelectStmt, *BranchStmt,
+		*ReturnStmt, *PanicStmt, *DeferStmt, *GoStmt, *YieldStmt, *SendStmt, *TryRecoverStmt, *Declaration:
 		return true
+	case *Function:
+		// a named function is a declaration
+		return n.Name != nil
 	default:
 		return false
 	}
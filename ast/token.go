@@ -22,10 +22,17 @@ const (
 	TokenBreak
 	TokenContinue
 	TokenFallthrough
+	TokenSwitch
+	TokenCase
+	TokenDefault
 	TokenTry
 	TokenRecover
 	TokenFinally
 	TokenPanic
+	TokenDefer
+	TokenGo
+	TokenSelect
+	TokenYield
 	TokenReturn
 	TokenNot
 	TokenIn
@@ -45,6 +52,10 @@ const (
 	TokenPipeeq
 	TokenAmpeq
 	TokenTildeeq
+	TokenLtlteq
+	TokenGtgteq
+	TokenModeq
+	TokenIntdiveq
 	assignOpEnd
 
 	// operators in order of precedence from lower-to-higher
@@ -69,6 +80,7 @@ const (
 	TokenTimes
 	TokenTimestimes
 	TokenDiv
+	TokenIntdiv
 	TokenLtlt
 	TokenGtgt
 	TokenAmp
@@ -78,6 +90,7 @@ const (
 	TokenPlusplus
 	TokenMinusminus
 	TokenMinusgt
+	TokenLarrow
 	TokenColon
 	TokenSemicolon
 	TokenComma
@@ -110,10 +123,17 @@ var (
 		"break":       TokenBreak,
 		"continue":    TokenContinue,
 		"fallthrough": TokenFallthrough,
+		"switch":      TokenSwitch,
+		"case":        TokenCase,
+		"default":     TokenDefault,
 		"try":         TokenTry,
 		"recover":     TokenRecover,
 		"finally":     TokenFinally,
 		"panic":       TokenPanic,
+		"defer":       TokenDefer,
+		"go":          TokenGo,
+		"select":      TokenSelect,
+		"yield":       TokenYield,
 		"return":      TokenReturn,
 		"not":         TokenNot,
 		"in":          TokenIn,
@@ -135,10 +155,17 @@ var (
 		TokenBreak:       "break",
 		TokenContinue:    "continue",
 		TokenFallthrough: "fallthrough",
+		TokenSwitch:      "switch",
+		TokenCase:        "case",
+		TokenDefault:     "default",
 		TokenTry:         "try",
 		TokenRecover:     "recover",
 		TokenFinally:     "finally",
 		TokenPanic:       "panic",
+		TokenDefer:       "defer",
+		TokenGo:          "go",
+		TokenSelect:      "select",
+		TokenYield:       "yield",
 		TokenReturn:      "return",
 		TokenNot:         "not",
 		TokenIn:          "in",
@@ -150,6 +177,7 @@ var (
 		TokenMinus:       "-",
 		TokenTimes:       "*",
 		TokenDiv:         "/",
+		TokenIntdiv:      "~/",
 		TokenAmpamp:      "&&",
 		TokenPipepipe:    "||",
 		TokenAmp:         "&",
@@ -172,10 +200,15 @@ var (
 		TokenAmpeq:       "&=",
 		TokenPipeeq:      "|=",
 		TokenTildeeq:     "^=",
+		TokenLtlteq:      "<<=",
+		TokenGtgteq:      ">>=",
+		TokenModeq:       "%=",
+		TokenIntdiveq:    "~/=",
 		TokenEqeq:        "==",
 		TokenPlusplus:    "++",
 		TokenMinusminus:  "--",
 		TokenMinusgt:     "->",
+		TokenLarrow:      "<-",
 		TokenColon:       ":",
 		TokenSemicolon:   ";",
 		TokenComma:       ",",
@@ -198,7 +231,7 @@ var (
 		30, 30,
 		40, 40, 40, 40,
 		50, 50, 50, 50,
-		60, 60, 60, 60, 60, 60, 60,
+		60, 60, 60, 60, 60, 60, 60, 60,
 	}
 )
 
@@ -220,7 +253,7 @@ func IsPostfixOp(tok Token) bool {
 
 func IsUnaryOp(tok Token) bool {
 	return IsPostfixOp(tok) ||
-		(tok == TokenNot || tok == TokenBang || tok == TokenMinus || tok == TokenPlus || tok == TokenTilde)
+		(tok == TokenNot || tok == TokenBang || tok == TokenMinus || tok == TokenPlus || tok == TokenTilde || tok == TokenLarrow)
 }
 
 func CompoundOp(tok Token) Token {
@@ -239,6 +272,14 @@ func CompoundOp(tok Token) Token {
 		return TokenPipe
 	case TokenTildeeq:
 		return TokenTilde
+	case TokenLtlteq:
+		return TokenLtlt
+	case TokenGtgteq:
+		return TokenGtgt
+	case TokenModeq:
+		return TokenMod
+	case TokenIntdiveq:
+		return TokenIntdiv
 	}
 	return Token(-1)
 }
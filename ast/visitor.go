@@ -31,9 +31,17 @@ type Visitor interface {
 	VisitBranchStmt(node *BranchStmt, data interface{})
 	VisitReturnStmt(node *ReturnStmt, data interface{})
 	VisitPanicStmt(node *PanicStmt, data interface{})
+	VisitDeferStmt(node *DeferStmt, data interface{})
+	VisitGoStmt(node *GoStmt, data interface{})
+	VisitYieldStmt(node *YieldStmt, data interface{})
+	VisitSendStmt(node *SendStmt, data interface{})
 	VisitIfStmt(node *IfStmt, data interface{})
 	VisitForIteratorStmt(node *ForIteratorStmt, data interface{})
 	VisitForStmt(node *ForStmt, data interface{})
+	VisitCaseClause(node *CaseClause, data interface{})
+	VisitSwitchStmt(node *SwitchStmt, data interface{})
+	VisitCommClause(node *CommClause, data interface{})
+	VisitSelectStmt(node *SelectStmt, data interface{})
 	VisitRecoverBlock(node *RecoverBlock, data interface{})
 	VisitTryRecoverStmt(node *TryRecoverStmt, data interface{})
 	VisitBlock(node *Block, data interface{})
@@ -2,26 +2,109 @@ package yo
 
 import (
 	"fmt"
+	"reflect"
+	"time"
 )
 
+var builtins = map[string]GoFunc{
+	"append":   builtinAppend,
+	"close":    builtinClose,
+	"getproto": builtinGetProto,
+	"hasOwn":   builtinHasOwn,
+	"isnumber": builtinIsNumber,
+	"len":      builtinLen,
+	"new":      builtinNew,
+	"println":  builtinPrintln,
+	"setproto": builtinSetProto,
+	"sleep":    builtinSleep,
+	"type":     builtinType,
+}
+
+// the names of the builtins by the address of their code, none
+// of them gives its arguments to the host, see VM.escapeCall
+var builtinNames = make(map[uintptr]string)
+
+func init() {
+	for name, fn := range builtins {
+		builtinNames[reflect.ValueOf(fn).Pointer()] = name
+	}
+}
+
 func defineBuiltins(vm *VM) {
-	vm.Define("append", GoFunc(builtinAppend))
-	vm.Define("isnumber", GoFunc(builtinIsNumber))
-	vm.Define("len", GoFunc(builtinLen))
-	vm.Define("println", GoFunc(builtinPrintln))
-	vm.Define("type", GoFunc(builtinType))
+	for name, fn := range builtins {
+		vm.Define(name, fn)
+	}
 }
 
+func isBuiltin(fn GoFunc) bool {
+	return builtinName(fn) != ""
+}
+
+// get the name of 'fn' in the builtins, empty if it's not one of them
+func builtinName(fn GoFunc) string {
+	return builtinNames[reflect.ValueOf(fn).Pointer()]
+}
+
+// append(arr, values...) appends the values to the array, or to the
+// wrapped Go slice, and returns it
 func builtinAppend(call *FuncCall) {
-	if call.NumArgs == uint(0) {
+	if g, ok := call.arg(0).(*GoObject); ok && g.goKind() == reflect.Slice {
+		if err := g.appendElems(call.Args[1:]); err != nil {
+			call.fail("%s", err)
+			return
+		}
+		call.PushReturnValue(g)
+		return
+	}
+	arr, ok := call.Array(0)
+	if !ok {
 		return
 	}
-
-	ptr := call.Args[0]
-	arr := ptr.(*Array)
 	*arr = append(*arr, call.Args[1:]...)
+	call.PushReturnValue(arr)
+}
+
+// close(ch) closes the channel, receiving from it yields
+// the values left in the buffer and then nil values
+func builtinClose(call *FuncCall) {
+	ch, ok := call.Chan(0)
+	if !ok {
+		return
+	}
+	defer func() {
+		if recover() != nil {
+			call.Error("close of closed channel")
+		}
+	}()
+	close(ch)
+}
+
+// getproto(obj) returns the object's prototype or nil
+func builtinGetProto(call *FuncCall) {
+	obj, ok := call.Object(0)
+	if !ok {
+		return
+	}
+	if obj.Parent == nil {
+		call.PushReturnValue(Nil{})
+	} else {
+		call.PushReturnValue(obj.Parent)
+	}
+}
 
-	call.PushReturnValue(ptr)
+// hasOwn(obj, key) reports whether the key is in the object's
+// own fields, ignoring the prototype chain
+func builtinHasOwn(call *FuncCall) {
+	obj, ok := call.Object(0)
+	if !ok {
+		return
+	}
+	key, ok := call.String(1)
+	if !ok {
+		return
+	}
+	_, has := obj.Fields[key]
+	call.PushReturnValue(Bool(has))
 }
 
 func builtinIsNumber(call *FuncCall) {
@@ -32,13 +115,54 @@ func builtinIsNumber(call *FuncCall) {
 	}
 }
 
+// len(v) returns the length of an array, the number of bytes
+// of a string, the number of own fields of an object or the
+// number of values in the buffer of a channel
 func builtinLen(call *FuncCall) {
-	if call.NumArgs == uint(0) {
-		panic("len expects 1 argument")
-	} else {
-		n := len(*(call.Args[0].(*Array)))
-		call.PushReturnValue(Number(n))
+	var n int
+	switch v := call.arg(0).(type) {
+	case *Array:
+		n = len(*v)
+	case String:
+		n = len(v)
+	case Chan:
+		n = len(v)
+	case *GoObject:
+		n = v.goLen() + len(v.Fields)
+	default:
+		obj, ok := toObject(v)
+		if !ok {
+			call.badArg(0, "an array, string, object or chan")
+			return
+		}
+		n = len(obj.Fields)
+	}
+	call.PushReturnValue(Number(n))
+}
+
+// new(proto, fields) creates an object whose prototype is 'proto',
+// the own fields of the optional 'fields' object are copied to it
+func builtinNew(call *FuncCall) {
+	if !call.Check(1) {
+		return
+	}
+	parent, ok := call.OptObject(0)
+	if !ok {
+		return
+	}
+	init, ok := call.OptObject(1)
+	if !ok {
+		return
 	}
+
+	fields := make(map[string]Value)
+	if init != nil {
+		for k, v := range init.Fields {
+			fields[k] = v
+		}
+	}
+
+	call.PushReturnValue(NewObject(parent, fields))
 }
 
 func builtinPrintln(call *FuncCall) {
@@ -49,6 +173,41 @@ func builtinPrintln(call *FuncCall) {
 	fmt.Println()
 }
 
+// setproto(obj, proto) changes the object's prototype, a nil proto
+// removes it, returns the object
+func builtinSetProto(call *FuncCall) {
+	if !call.Check(2) {
+		return
+	}
+	obj, ok := call.Object(0)
+	if !ok {
+		return
+	}
+
+	parent, ok := call.OptObject(1)
+	if !ok {
+		return
+	}
+	for p := parent; p != nil; p = p.Parent {
+		if p == obj {
+			call.Error("setproto would create a prototype cycle")
+			return
+		}
+	}
+
+	obj.Parent = parent
+	call.PushReturnValue(call.Args[0])
+}
+
+// sleep(seconds) pauses the goroutine, the others run meanwhile
+func builtinSleep(call *FuncCall) {
+	seconds, ok := call.Number(0)
+	if !ok {
+		return
+	}
+	call.vm.sleep(time.Duration(seconds * float64(time.Second)))
+}
+
 func builtinType(call *FuncCall) {
 	if call.NumArgs <= uint(0) {
 		call.PushReturnValue(String("nil"))
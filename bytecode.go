@@ -7,21 +7,42 @@ type LineInfo struct {
 	Line  uint16
 }
 
+// Describes a variable of an enclosing function
+// captured by a closure
+type UpvalueDesc struct {
+	Name    string
+	Instack bool   // true if it's a register of the enclosing function
+	Index   uint32 // register or upvalue index in the enclosing function
+}
+
 // Contains executable code by the VM and
 // static information generated at compilation time.
 // All runtime functions reference one of these
 type Bytecode struct {
-	Source    string
-	NumConsts uint32
-	NumCode   uint32
-	NumLines  uint32
-	NumFuncs  uint32
-	Consts    []Value
-	Code      []uint32
-	Lines     []LineInfo
-	Funcs     []*Bytecode
+	Source      string
+	Name        string   // name of the function, empty if anonymous
+	NumArgs     uint32   // declared arguments, not counting 'this' and the variadic one
+	ArgNames    []string // names of the declared arguments, for keyword arguments
+	Variadic    bool     // the extra arguments are collected in an array after the declared ones
+	Generator   bool     // the function yields, calling it makes a Generator
+	NumConsts   uint32
+	NumCode     uint32
+	NumLines    uint32
+	NumFuncs    uint32
+	NumUpvalues uint32
+	Consts      []Value
+	Code        []uint32
+	Lines       []LineInfo
+	Funcs       []*Bytecode
+	Upvalues    []UpvalueDesc
+	JumpTables  []JumpTable
+	CallNames   map[int]string // the names of the called functions by the index of the call, see FuncCall.Name
 }
 
+// Maps the constant values of the cases of a switch
+// to the offsets of their clauses, see OpSwitch
+type JumpTable map[Value]int
+
 const (
 	bytecodeMaxConsts = 0xffff
 )
@@ -31,3 +52,25 @@ func newBytecode(source string) *Bytecode {
 		Source: source,
 	}
 }
+
+// get the index of the declared argument 'name', -1 if there's none
+func (b *Bytecode) argIndex(name string) int {
+	for i, arg := range b.ArgNames {
+		if arg == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// get the source line of the instruction at index 'pc'
+func (b *Bytecode) lineAt(pc int) int {
+	var line int
+	for _, info := range b.Lines {
+		if int(info.Instr) > pc {
+			break
+		}
+		line = int(info.Line)
+	}
+	return line
+}
@@ -49,8 +49,11 @@ type (
 		register int
 		names    map[string]*nameInfo
 		loop     *loopInfo
+		finally  *ast.Block // only set if context == kBlockContextTry
 		bytecode *Bytecode
 		parent   *compilerBlock
+		start    int  // the first register of the block
+		captured bool // some local of the block (or of an inner one) is an upvalue
 	}
 
 	compiler struct {
@@ -73,8 +76,21 @@ const (
 	kBlockContextFunc blockContext = iota
 	kBlockContextLoop
 	kBlockContextBranch
+	kBlockContextTry
+	kBlockContextSwitch
 )
 
+// opcodes of the operations which may fail, see constFold
+var integerOps = map[ast.Token]Opcode{
+	ast.TokenMod:    OpMod,
+	ast.TokenIntdiv: OpIntdiv,
+	ast.TokenLtlt:   OpShl,
+	ast.TokenGtgt:   OpShr,
+	ast.TokenAmp:    OpAnd,
+	ast.TokenPipe:   OpOr,
+	ast.TokenTilde:  OpXor,
+}
+
 // How much registers an array can use at one time
 // when it's created in literal form (see VisitArray)
 const kArrayMaxRegisters = 10
@@ -101,7 +117,13 @@ func (b *compilerBlock) nameInfo(name string) (*nameInfo, bool) {
 		info, ok := block.names[name]
 		if ok {
 			if closures > 0 && info.scope == kScopeLocal {
-				info.scope = kScopeClosure
+				// the name is a local of an enclosing function,
+				// inside this one it can only be reached as an upvalue,
+				// so the blocks left by the enclosing function must close it
+				for b := info.block; b.context != kBlockContextFunc; b = b.parent {
+					b.captured = true
+				}
+				return &nameInfo{info.isConst, info.value, info.reg, kScopeClosure, info.block}, true
 			}
 			return info, true
 		}
@@ -114,6 +136,31 @@ func (b *compilerBlock) nameInfo(name string) (*nameInfo, bool) {
 	return nil, false
 }
 
+// same as nameInfo, but doesn't look past the enclosing function
+func (b *compilerBlock) localNameInfo(name string) (*nameInfo, bool) {
+	block := b
+	for block != nil {
+		info, ok := block.names[name]
+		if ok {
+			return info, true
+		}
+		if block.context == kBlockContextFunc {
+			break
+		}
+		block = block.parent
+	}
+
+	return nil, false
+}
+
+func (b *compilerBlock) funcBlock() *compilerBlock {
+	block := b
+	for block.context != kBlockContextFunc {
+		block = block.parent
+	}
+	return block
+}
+
 func (b *compilerBlock) addNameInfo(name string, info *nameInfo) {
 	info.block = b
 	b.names[name] = info
@@ -192,12 +239,26 @@ func (c *compiler) declareLocalVar(name string, reg int) {
 	c.block.addNameInfo(name, &nameInfo{false, nil, reg, kScopeLocal, c.block})
 }
 
+// names declared in the outermost block of the main function
+// are globals, so they are visible to the host through VM.Globals
+func (c *compiler) topLevel() bool {
+	return c.block.parent == nil
+}
+
+func (c *compiler) declareGlobalVar(name string) {
+	if _, ok := c.block.names[name]; ok {
+		c.error(c.lastLine, fmt.Sprintf("cannot redeclare '%s'", name))
+	}
+	c.block.addNameInfo(name, &nameInfo{false, nil, 0, kScopeGlobal, c.block})
+}
+
 func (c *compiler) enterBlock(context blockContext) {
 	assert(c.block != nil, "c.block enterBlock")
 	block := newCompilerBlock(c.block.bytecode, context, c.block)
 	block.register = c.block.register
+	block.start = block.register
 
-	if context == kBlockContextLoop {
+	if context == kBlockContextLoop || context == kBlockContextSwitch {
 		block.loop = &loopInfo{}
 	} else if c.block.loop != nil {
 		block.loop = c.block.loop
@@ -207,7 +268,7 @@ func (c *compiler) enterBlock(context blockContext) {
 
 func (c *compiler) leaveBlock() {
 	block := c.block
-	if block.context == kBlockContextLoop {
+	if block.context == kBlockContextLoop || block.context == kBlockContextSwitch {
 		loop := block.loop
 		for _, index := range loop.breaks {
 			c.modifyAsBx(int(index), OpJmp, 0, int(loop.breakTarget-index-1))
@@ -216,21 +277,90 @@ func (c *compiler) leaveBlock() {
 			c.modifyAsBx(int(index), OpJmp, 0, int(loop.continueTarget-index-1))
 		}
 	}
+	c.closeBlock(block)
 	c.block = block.parent
 }
 
-func (c *compiler) insideLoop() bool {
+// close the upvalues of the locals of 'block', the closures which
+// captured them must not see the registers reused by the next ones
+func (c *compiler) closeBlock(block *compilerBlock) {
+	if block.captured && block.context != kBlockContextFunc {
+		c.emitAB(OpClose, block.start, 0, c.lastLine)
+	}
+}
+
+// compile 'node' inside a new block
+func (c *compiler) blockHelper(node ast.Node, context blockContext) {
+	c.enterBlock(context)
+	node.Accept(c, nil)
+	c.leaveBlock()
+}
+
+// emit the code needed to jump out of the try blocks between the
+// current block and 'target', popping their handlers and running
+// their finally blocks from the innermost to the outermost
+func (c *compiler) leaveTryBlocks(target *compilerBlock, line int) {
+	for block := c.block; block != target; block = block.parent {
+		if block.context != kBlockContextTry {
+			continue
+		}
+		c.emitAB(OpTryend, 0, 0, line)
+		if block.finally == nil {
+			continue
+		}
+
+		// the finally block sees only the names outside of the try,
+		// and leaving it early must not run it again
+		current := c.block
+		c.block = newCompilerBlock(current.bytecode, kBlockContextBranch, block.parent)
+		c.block.register = current.register
+		c.block.loop = block.parent.loop
+		block.finally.Accept(c, nil)
+		c.block = current
+	}
+}
+
+// get the block which a 'break' or 'continue' jumps out of,
+// nil if there's none in the current function
+func (c *compiler) branchTarget(typ ast.Token) *compilerBlock {
 	block := c.block
 	for block != nil {
 		if block.context == kBlockContextLoop {
-			return true
+			return block
+		}
+		if block.context == kBlockContextSwitch && typ == ast.TokenBreak {
+			return block
 		}
 		if block.context == kBlockContextFunc {
-			return false
+			return nil
 		}
 		block = block.parent
 	}
-	return false
+	return nil
+}
+
+// Get the index of the upvalue 'name' in the function which 'block' belongs to,
+// the upvalue is created in this and in the enclosing functions as needed
+func (c *compiler) upvalueIndex(block *compilerBlock, name string) int {
+	fn := block.funcBlock()
+	f := fn.bytecode
+	for i, uv := range f.Upvalues {
+		if uv.Name == name {
+			return i
+		}
+	}
+
+	desc := UpvalueDesc{Name: name}
+	if info, ok := fn.parent.localNameInfo(name); ok {
+		desc.Instack = true
+		desc.Index = uint32(info.reg)
+	} else {
+		desc.Index = uint32(c.upvalueIndex(fn.parent, name))
+	}
+
+	f.Upvalues = append(f.Upvalues, desc)
+	f.NumUpvalues++
+	return int(f.NumUpvalues - 1)
 }
 
 // Add a constant to the current bytecodetype's constant pool
@@ -297,6 +427,15 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 				return Number(-f64), true
 			}
 			return nil, false
+		} else if t.Op == ast.TokenTilde {
+			val, ok := c.constFold(t.Right)
+			if ok && val.Type() == ValueNumber {
+				f64, _ := val.assertFloat64()
+				if isInt(f64) {
+					return Number(float64(^int64(f64))), true
+				}
+			}
+			return nil, false
 		} else {
 			// 'not' operator
 			val, ok := c.constFold(t.Right)
@@ -307,6 +446,18 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 			return nil, false
 		}
 	case *ast.BinaryExpr:
+		if t.Op == ast.TokenAmpamp || t.Op == ast.TokenPipepipe {
+			// the result is the operand which decides the expression
+			left, ok := c.constFold(t.Left)
+			if !ok {
+				return nil, false
+			}
+			if left.ToBool() == (t.Op == ast.TokenPipepipe) {
+				return left, true
+			}
+			return c.constFold(t.Right)
+		}
+
 		left, leftOk := c.constFold(t.Left)
 		right, rightOk := c.constFold(t.Right)
 		if leftOk && rightOk {
@@ -349,13 +500,23 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 				ret = Bool(lf64 >= rf64)
 			case ast.TokenEqeq:
 				ret = Bool(lf64 == rf64)
+			case ast.TokenBangeq:
+				ret = Bool(lf64 != rf64)
+			case ast.TokenMod, ast.TokenIntdiv, ast.TokenLtlt, ast.TokenGtgt,
+				ast.TokenAmp, ast.TokenPipe, ast.TokenTilde:
+				// operations that can fail are left for the runtime to report
+				if f, err := numberArith(integerOps[t.Op], lf64, rf64); err == nil {
+					ret = Number(f)
+				} else {
+					return nil, false
+				}
 			}
 			if ret != nil {
 				return ret, true
 			}
 
 		boolOps:
-			// not arithmetic/relational, maybe logic?
+			// not arithmetic/relational, maybe bool equality?
 			lb, ok := left.assertBool()
 			rb, _ := right.assertBool()
 			if !ok {
@@ -363,10 +524,10 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 			}
 
 			switch t.Op {
-			case ast.TokenAmpamp:
-				return Bool(lb && rb), true
-			case ast.TokenPipepipe:
-				return Bool(lb || rb), true
+			case ast.TokenEqeq:
+				return Bool(lb == rb), true
+			case ast.TokenBangeq:
+				return Bool(lb != rb), true
 			}
 
 		stringOps:
@@ -397,13 +558,24 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 	return nil, false
 }
 
+// function calls and receives (v, ok := <-ch) may give multiple values
+func multipleValues(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.CallExpr:
+		return true
+	case *ast.UnaryExpr:
+		return n.Op == ast.TokenLarrow
+	}
+	return false
+}
+
 // declare local variables
 // assignments are done in sequence, since the registers are created as needed
 func (c *compiler) declare(names []*ast.Id, values []ast.Node) {
 	var isCall, isUnpack bool
 	nameCount, valueCount := len(names), len(values)
 	if valueCount > 0 {
-		_, isCall = values[valueCount-1].(*ast.CallExpr)
+		isCall = multipleValues(values[valueCount-1])
 		_, isUnpack = values[valueCount-1].(*ast.VarArg)
 	}
 	start := c.block.register
@@ -428,11 +600,15 @@ func (c *compiler) declare(names []*ast.Id, values []ast.Node) {
 					c.error(id.NodeInfo.Line, fmt.Sprintf("cannot redeclare '%s'", id.Value))
 				}
 				end = c.genRegister()
-				c.block.addNameInfo(id.Value, &nameInfo{false, nil, end, kScopeLocal, c.block})
 				rem++
 			}
 			exprdata.regb, start = end, end+1
 			values[i].Accept(c, &exprdata)
+
+			for j, id := range names[i:] {
+				c.block.addNameInfo(id.Value, &nameInfo{false, nil, reg + j, kScopeLocal, c.block})
+			}
+			break
 		} else if i < valueCount {
 			values[i].Accept(c, &exprdata)
 			start = reg + 1
@@ -445,6 +621,16 @@ func (c *compiler) declare(names []*ast.Id, values []ast.Node) {
 		// variables without initializer are set to nil
 		c.emitAB(OpLoadnil, start, end, names[0].NodeInfo.Line)
 	}
+	if c.topLevel() {
+		// the values were evaluated in registers, now move them
+		// to the globals and release the registers
+		for _, id := range names {
+			info := c.block.names[id.Value]
+			c.emitABx(OpSetglobal, info.reg, c.addConst(String(id.Value)), id.NodeInfo.Line)
+			info.scope = kScopeGlobal
+		}
+		c.block.register -= nameCount
+	}
 }
 
 func (c *compiler) assignmentHelper(left ast.Node, assignReg int, valueReg int) {
@@ -460,19 +646,20 @@ func (c *compiler) assignmentHelper(left ast.Node, assignReg int, valueReg int)
 		switch scope {
 		case kScopeLocal:
 			c.emitAB(OpMove, info.reg, valueReg, v.NodeInfo.Line)
-		case kScopeClosure, kScopeGlobal:
-			op := OpSetglobal
-			if scope == kScopeClosure {
-				op = OpSetFree
-			}
-			c.emitABx(op, valueReg, c.addConst(String(v.Value)), v.NodeInfo.Line)
+		case kScopeClosure:
+			c.emitABx(OpSetFree, valueReg, c.upvalueIndex(c.block, v.Value), v.NodeInfo.Line)
+		case kScopeGlobal:
+			c.emitABx(OpSetglobal, valueReg, c.addConst(String(v.Value)), v.NodeInfo.Line)
 		}
 	case *ast.Subscript:
+		if _, ok := v.Right.(*ast.Slice); ok {
+			c.error(v.NodeInfo.Line, "cannot assign to a slice expression")
+		}
 		arrData := exprdata{true, assignReg, assignReg}
 		v.Left.Accept(c, &arrData)
 		arrReg := arrData.regb
 
-		subData := exprdata{true, assignReg, assignReg}
+		subData := exprdata{true, assignReg + 1, assignReg + 1}
 		v.Right.Accept(c, &subData)
 		subReg := subData.regb
 		c.emitABC(OpSetIndex, arrReg, subReg, valueReg, v.NodeInfo.Line)
@@ -486,31 +673,120 @@ func (c *compiler) assignmentHelper(left ast.Node, assignReg int, valueReg int)
 	}
 }
 
+// read the variable, field or element 'target' in a register, call 'modify'
+// with it and write it back, the object and key expressions of the target
+// are evaluated only once. The value is loaded in 'reg' (unless it's a
+// local variable) and 'modify' can use the registers from reg+3 upwards.
+func (c *compiler) readModifyWrite(target ast.Node, reg int, modify func(value int)) {
+	switch v := target.(type) {
+	case *ast.Id:
+		var scope scope
+		info, ok := c.block.nameInfo(v.Value)
+		if !ok {
+			scope = kScopeGlobal
+		} else {
+			scope = info.scope
+		}
+		switch scope {
+		case kScopeLocal:
+			if info.isConst {
+				c.error(v.NodeInfo.Line, fmt.Sprintf("cannot assign to constant '%s'", v.Value))
+			}
+			modify(info.reg)
+		case kScopeClosure:
+			index := c.upvalueIndex(c.block, v.Value)
+			c.emitABx(OpLoadFree, reg, index, v.NodeInfo.Line)
+			modify(reg)
+			c.emitABx(OpSetFree, reg, index, v.NodeInfo.Line)
+		case kScopeGlobal:
+			name := c.addConst(String(v.Value))
+			c.emitABx(OpLoadglobal, reg, name, v.NodeInfo.Line)
+			modify(reg)
+			c.emitABx(OpSetglobal, reg, name, v.NodeInfo.Line)
+		}
+	case *ast.Selector, *ast.Subscript:
+		var left, right ast.Node
+		var key int
+		if sel, ok := v.(*ast.Selector); ok {
+			left = sel.Left
+			key = OpConstOffset + c.addConst(String(sel.Value))
+		} else {
+			sub := v.(*ast.Subscript)
+			if _, ok := sub.Right.(*ast.Slice); ok {
+				c.error(sub.NodeInfo.Line, "cannot assign to a slice expression")
+			}
+			left, right = sub.Left, sub.Right
+		}
+
+		objData := exprdata{false, reg + 1, reg + 1}
+		left.Accept(c, &objData)
+		if right != nil {
+			keyData := exprdata{true, reg + 2, reg + 2}
+			right.Accept(c, &keyData)
+			key = keyData.regb
+		}
+
+		c.emitABC(OpGetIndex, reg, reg+1, key, c.lastLine)
+		modify(reg)
+		c.emitABC(OpSetIndex, reg+1, key, reg, c.lastLine)
+	default:
+		c.error(c.lastLine, "non-assignable operand")
+	}
+}
+
+// the A argument of the conditional jumps only has room for the
+// first few constants, the others are loaded in 'reg' to be tested
+func (c *compiler) jumpCondition(cond, reg int) int {
+	if cond > kArgAMask {
+		c.emitABx(OpLoadconst, reg, cond-OpConstOffset, c.lastLine)
+		return reg
+	}
+	return cond
+}
+
 func (c *compiler) branchConditionHelper(cond, then, else_ ast.Node, reg int) {
 	ternaryData := exprdata{true, reg + 1, reg + 1}
 	cond.Accept(c, &ternaryData)
-	condr := ternaryData.regb
+	condr := c.jumpCondition(ternaryData.regb, reg+1)
 	jmpInstr := c.emitAsBx(OpJmpfalse, condr, 0, c.lastLine)
 	thenLabel := c.newLabel()
 
 	ternaryData = exprdata{false, reg, reg}
 	then.Accept(c, &ternaryData)
-	c.modifyAsBx(jmpInstr, OpJmpfalse, condr, c.labelOffset(thenLabel))
 
 	if else_ != nil {
 		successInstr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+		// the false branch skips the jump over the else
+		c.modifyAsBx(jmpInstr, OpJmpfalse, condr, c.labelOffset(thenLabel))
 
 		elseLabel := c.newLabel()
 		ternaryData = exprdata{false, reg, reg}
 		else_.Accept(c, &ternaryData)
 
 		c.modifyAsBx(successInstr, OpJmp, 0, c.labelOffset(elseLabel))
+	} else {
+		c.modifyAsBx(jmpInstr, OpJmpfalse, condr, c.labelOffset(thenLabel))
 	}
 }
 
+// name of a function for error messages, e.g.: 'add' or 'Vector3.mul'
+func functionName(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.Id:
+		return n.Value
+	case *ast.Selector:
+		left := functionName(n.Left)
+		if left == "" {
+			return ""
+		}
+		return left + "." + n.Value
+	}
+	return ""
+}
+
 func (c *compiler) functionReturnGuard() {
-	last := c.block.bytecode.Code[c.block.bytecode.NumCode-1]
-	if OpGetOpcode(last) != OpReturn {
+	f := c.block.bytecode
+	if f.NumCode == 0 || OpGetOpcode(f.Code[f.NumCode-1]) != OpReturn {
 		c.emitAB(OpReturn, 0, 0, c.lastLine)
 	}
 }
@@ -609,11 +885,11 @@ func (c *compiler) VisitId(node *ast.Id, data interface{}) {
 		}
 		c.emitAB(OpMove, reg, info.reg, node.NodeInfo.Line)
 	case kScopeClosure, kScopeGlobal:
-		op := OpLoadglobal
 		if scope == kScopeClosure {
-			op = OpLoadFree
+			c.emitABx(OpLoadFree, reg, c.upvalueIndex(c.block, node.Value), node.NodeInfo.Line)
+		} else {
+			c.emitABx(OpLoadglobal, reg, c.addConst(String(node.Value)), node.NodeInfo.Line)
 		}
-		c.emitABx(op, reg, c.addConst(String(node.Value)), node.NodeInfo.Line)
 		if exprok && expr.propagate {
 			expr.regb = reg
 		}
@@ -689,8 +965,18 @@ func (c *compiler) VisitFunction(node *ast.Function, data interface{}) {
 	} else {
 		reg = c.genRegister()
 	}
+	// declare the name before the body, so the function can call itself
+	name, isId := node.Name.(*ast.Id)
+	global := isId && c.topLevel()
+	if global {
+		c.declareGlobalVar(name.Value)
+	} else if isId {
+		c.declareLocalVar(name.Value, reg)
+	}
+
 	parent := c.block.bytecode
 	bytecode := newBytecode(parent.Source)
+	bytecode.Name = functionName(node.Name)
 
 	block := newCompilerBlock(bytecode, kBlockContextFunc, c.block)
 	c.block = block
@@ -702,27 +988,59 @@ func (c *compiler) VisitFunction(node *ast.Function, data interface{}) {
 	// insert 'this' into scope
 	c.declareLocalVar("this", c.genRegister())
 
-	// insert arguments into scope
+	// insert arguments into scope, the variadic argument
+	// comes last and receives an array with the extra ones
+	var defaults []*ast.KwArg
 	for _, n := range node.Args {
+		var name string
 		switch arg := n.(type) {
 		case *ast.Id:
-			reg := c.genRegister()
-			c.block.addNameInfo(arg.Value, &nameInfo{false, nil, reg, kScopeLocal, c.block})
+			name = arg.Value
+		case *ast.KwArg:
+			name = arg.Key
+			defaults = append(defaults, arg)
+		case *ast.VarArg:
+			name = arg.Arg.(*ast.Id).Value
+			bytecode.Variadic = true
+		}
+		c.declareLocalVar(name, c.genRegister())
+		if !bytecode.Variadic {
+			bytecode.ArgNames = append(bytecode.ArgNames, name)
+			bytecode.NumArgs++
 		}
 	}
 
+	// default values are assigned to the arguments which are nil
+	for _, arg := range defaults {
+		nilConst := OpConstOffset + c.addConst(Nil{})
+		reg := c.block.names[arg.Key].reg
+		test := c.block.register
+		c.emitABC(OpEq, test, reg, nilConst, arg.NodeInfo.Line)
+		jmpInstr := c.emitAsBx(OpJmpfalse, test, 0, arg.NodeInfo.Line)
+		label := c.newLabel()
+
+		argData := exprdata{false, reg, reg}
+		arg.Accept(c, &argData)
+		c.modifyAsBx(jmpInstr, OpJmpfalse, test, c.labelOffset(label))
+	}
+
 	node.Body.Accept(c, nil)
 	c.functionReturnGuard()
 
 	c.block = c.block.parent
 	c.emitABx(OpFunc, reg, index, node.NodeInfo.Line)
 
-	if node.Name != nil {
-		switch name := node.Name.(type) {
-		case *ast.Id:
-			c.declareLocalVar(name.Value, reg)
-		default:
-			c.assignmentHelper(name, reg+1, reg)
+	if global {
+		c.emitABx(OpSetglobal, reg, c.addConst(String(name.Value)), node.NodeInfo.Line)
+		if !exprok {
+			c.block.register--
+		}
+	}
+	if node.Name != nil && !isId {
+		c.assignmentHelper(node.Name, reg+1, reg)
+		if !exprok {
+			// the function is only referenced by the assignment
+			c.block.register--
 		}
 	}
 	if exprok && expr.propagate {
@@ -745,7 +1063,7 @@ func (c *compiler) VisitSelector(node *ast.Selector, data interface{}) {
 	key := OpConstOffset + c.addConst(String(node.Value))
 	c.emitABC(OpGetIndex, reg, objReg, key, node.NodeInfo.Line)
 	if exprok && expr.propagate {
-		expr.regb = objReg
+		expr.regb = reg
 	}
 }
 
@@ -760,14 +1078,23 @@ func (c *compiler) VisitSubscript(node *ast.Subscript, data interface{}) {
 	arrData := exprdata{true, reg + 1, reg + 1}
 	node.Left.Accept(c, &arrData)
 	arrReg := arrData.regb
+	if arrReg >= OpConstOffset {
+		// a constant string, the indexed value must be in a register
+		c.emitABx(OpLoadconst, reg+1, arrReg-OpConstOffset, c.lastLine)
+		arrReg = reg + 1
+	}
 
-	_, ok := node.Right.(*ast.Slice)
-	if ok {
-		// TODO: generate code for slice
+	if slice, ok := node.Right.(*ast.Slice); ok {
+		boundsData := exprdata{false, reg + 2, reg + 3}
+		slice.Accept(c, &boundsData)
+		c.emitABC(OpSlice, reg, arrReg, reg+2, node.NodeInfo.Line)
+		if exprok && expr.propagate {
+			expr.regb = reg
+		}
 		return
 	}
 
-	indexData := exprdata{true, reg + 1, reg + 1}
+	indexData := exprdata{true, reg + 2, reg + 2}
 	node.Right.Accept(c, &indexData)
 	indexReg := indexData.regb
 	c.emitABC(OpGetIndex, reg, arrReg, indexReg, node.NodeInfo.Line)
@@ -777,16 +1104,41 @@ func (c *compiler) VisitSubscript(node *ast.Subscript, data interface{}) {
 	}
 }
 
+// load the bounds of the slice in data.rega and data.regb,
+// missing bounds are loaded as nil
 func (c *compiler) VisitSlice(node *ast.Slice, data interface{}) {
-
+	expr, _ := data.(*exprdata)
+	for i, bound := range [2]ast.Node{node.Start, node.End} {
+		reg := expr.rega + i
+		if bound == nil {
+			c.emitAB(OpLoadnil, reg, reg, node.NodeInfo.Line)
+			continue
+		}
+		boundData := exprdata{false, reg, reg}
+		bound.Accept(c, &boundData)
+	}
 }
 
+// compile the value of a keyword argument, or the default value of
+// an argument (see VisitFunction and VisitCallExpr)
 func (c *compiler) VisitKwArg(node *ast.KwArg, data interface{}) {
-
+	node.Value.Accept(c, data)
 }
 
+// unpack an array in the registers data.rega ... data.regb,
+// spreading in function calls is done by VisitCallExpr
 func (c *compiler) VisitVarArg(node *ast.VarArg, data interface{}) {
-
+	expr, ok := data.(*exprdata)
+	if !ok {
+		c.error(node.NodeInfo.Line, "cannot unpack outside of an assignment")
+	}
+	arrReg := expr.regb + 1
+	arrData := exprdata{false, arrReg, arrReg}
+	node.Arg.Accept(c, &arrData)
+	for reg := expr.rega; reg <= expr.regb; reg++ {
+		index := OpConstOffset + c.addConst(Number(reg-expr.rega))
+		c.emitABC(OpGetIndex, reg, arrReg, index, node.NodeInfo.Line)
+	}
 }
 
 func (c *compiler) VisitCallExpr(node *ast.CallExpr, data interface{}) {
@@ -801,6 +1153,26 @@ func (c *compiler) VisitCallExpr(node *ast.CallExpr, data interface{}) {
 		resultCount = 1
 	}
 
+	// 'recover' is a keyword, so it can't be shadowed
+	if id, ok := node.Left.(*ast.Id); ok && id.Value == "recover" {
+		if len(node.Args) > 0 {
+			c.error(node.NodeInfo.Line, "recover takes no arguments")
+		}
+		c.emitAB(OpRecover, startReg, 0, node.NodeInfo.Line)
+		if endReg > startReg {
+			c.emitAB(OpLoadnil, startReg+1, endReg, node.NodeInfo.Line)
+		}
+		return
+	}
+
+	// make(chan) and make(chan, size) create channels, unless 'make' is declared
+	if id, ok := node.Left.(*ast.Id); ok && id.Value == "make" {
+		if _, declared := c.block.nameInfo(id.Value); !declared {
+			c.makeChanHelper(node, startReg, endReg)
+			return
+		}
+	}
+
 	// check if it's a type conversion (string, number, bool)
 	v, ok := c.constFold(node)
 	if ok {
@@ -808,32 +1180,111 @@ func (c *compiler) VisitCallExpr(node *ast.CallExpr, data interface{}) {
 		return
 	}
 
-	argCount := len(node.Args)
+	var argCount int
 	var op Opcode
-	switch node.Left.(type) {
+	switch left := node.Left.(type) {
 	case *ast.Selector:
 		op = OpCallmethod
-		callerData := exprdata{true, startReg, startReg}
-		node.Left.Accept(c, &callerData)
-		objReg := callerData.regb
 
 		// insert object as first argument
 		endReg += 1
 		argCount += 1
-		c.emitAB(OpMove, endReg, objReg, node.NodeInfo.Line)
+		objData := exprdata{false, endReg, endReg}
+		left.Left.Accept(c, &objData)
+
+		key := OpConstOffset + c.addConst(String(left.Value))
+		c.emitABC(OpGetIndex, startReg, endReg, key, left.NodeInfo.Line)
 	default:
 		op = OpCall
 		callerData := exprdata{false, startReg, startReg}
 		node.Left.Accept(c, &callerData)
 	}
 
-	for i, arg := range node.Args {
-		reg := endReg + i + 1
-		argData := exprdata{false, reg, reg}
-		arg.Accept(c, &argData)
+	// the positional arguments come first, followed by the array
+	// to spread, if any, and by an object with the keyword arguments
+	var flags int
+	var kwargs []*ast.KwArg
+	argReg := endReg + 1
+	for _, arg := range node.Args {
+		if kwarg, ok := arg.(*ast.KwArg); ok {
+			for _, other := range kwargs {
+				if other.Key == kwarg.Key {
+					c.error(kwarg.NodeInfo.Line, fmt.Sprintf("duplicate keyword argument '%s'", kwarg.Key))
+				}
+			}
+			kwargs = append(kwargs, kwarg)
+			continue
+		}
+		if len(kwargs) > 0 {
+			c.error(node.NodeInfo.Line, "positional argument after keyword argument")
+		}
+		if flags&OpCallSpread != 0 {
+			c.error(node.NodeInfo.Line, "argument after spread argument")
+		}
+
+		argData := exprdata{false, argReg, argReg}
+		if spread, ok := arg.(*ast.VarArg); ok {
+			spread.Arg.Accept(c, &argData)
+			flags |= OpCallSpread
+		} else {
+			arg.Accept(c, &argData)
+		}
+		argReg++
+	}
+
+	if len(kwargs) > 0 {
+		c.emitAB(OpObject, argReg, 0, node.NodeInfo.Line)
+		for _, kwarg := range kwargs {
+			valueData := exprdata{true, argReg + 1, argReg + 1}
+			kwarg.Accept(c, &valueData)
+			key := OpConstOffset + c.addConst(String(kwarg.Key))
+			c.emitABC(OpSetIndex, argReg, key, valueData.regb, kwarg.NodeInfo.Line)
+		}
+		argReg++
+		flags |= OpCallKwargs
 	}
 
-	c.emitABC(op, startReg, resultCount, argCount, node.NodeInfo.Line)
+	argCount += argReg - endReg - 1
+	if argCount > OpCallArgsMask {
+		c.error(node.NodeInfo.Line, "too many arguments")
+	}
+	instr := c.emitABC(op, startReg, resultCount, argCount|flags, node.NodeInfo.Line)
+
+	// the host functions tell their name in the errors
+	var name string
+	switch left := node.Left.(type) {
+	case *ast.Id:
+		name = left.Value
+	case *ast.Selector:
+		name = left.Value
+	}
+	if name != "" {
+		f := c.block.bytecode
+		if f.CallNames == nil {
+			f.CallNames = make(map[int]string)
+		}
+		f.CallNames[instr] = name
+	}
+}
+
+func (c *compiler) makeChanHelper(node *ast.CallExpr, startReg, endReg int) {
+	if len(node.Args) == 0 || len(node.Args) > 2 {
+		c.error(node.NodeInfo.Line, "make expects chan and an optional size")
+	}
+	if typ, ok := node.Args[0].(*ast.Id); !ok || typ.Value != "chan" {
+		c.error(node.NodeInfo.Line, "make can only create channels")
+	}
+
+	size := OpConstOffset + c.addConst(Number(0))
+	if len(node.Args) == 2 {
+		sizeData := exprdata{true, startReg, startReg}
+		node.Args[1].Accept(c, &sizeData)
+		size = sizeData.regb
+	}
+	c.emitAB(OpMakechan, startReg, size, node.NodeInfo.Line)
+	if endReg > startReg {
+		c.emitAB(OpLoadnil, startReg+1, endReg, node.NodeInfo.Line)
+	}
 }
 
 func (c *compiler) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
@@ -851,16 +1302,19 @@ func (c *compiler) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
 	case ast.TokenMinusminus:
 		op = OpSub
 	}
-	leftdata := exprdata{true, reg, reg}
-	node.Left.Accept(c, &leftdata)
-	left := leftdata.regb
 	one := OpConstOffset + c.addConst(Number(1))
 
-	// don't bother moving if we're not in an expression
-	if exprok {
-		c.emitAB(OpMove, reg, left, node.NodeInfo.Line)
+	// the result is the value before the increment
+	c.readModifyWrite(node.Left, reg+1, func(value int) {
+		// don't bother moving if we're not in an expression
+		if exprok {
+			c.emitAB(OpMove, reg, value, node.NodeInfo.Line)
+		}
+		c.emitABC(op, value, value, one, node.NodeInfo.Line)
+	})
+	if exprok && expr.propagate {
+		expr.regb = reg
 	}
-	c.emitABC(op, left, left, one, node.NodeInfo.Line)
 }
 
 func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
@@ -883,14 +1337,35 @@ func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
 		if node.Op == ast.TokenMinusminus {
 			op = OpSub
 		}
-		exprdata := exprdata{true, reg, reg}
-		node.Right.Accept(c, &exprdata)
 		one := OpConstOffset + c.addConst(Number(1))
-		c.emitABC(op, exprdata.regb, exprdata.regb, one, node.NodeInfo.Line)
 
-		// don't bother moving if we're not in an expression
-		if exprok {
-			c.emitAB(OpMove, reg, exprdata.regb, node.NodeInfo.Line)
+		// the result is the value after the increment
+		c.readModifyWrite(node.Right, reg+1, func(value int) {
+			c.emitABC(op, value, value, one, node.NodeInfo.Line)
+
+			// don't bother moving if we're not in an expression
+			if exprok {
+				c.emitAB(OpMove, reg, value, node.NodeInfo.Line)
+			}
+		})
+		if exprok && expr.propagate {
+			expr.regb = reg
+		}
+	} else if node.Op == ast.TokenLarrow {
+		// a receive gives the value and, if there's another
+		// register for it, whether the channel is still open
+		chanData := exprdata{false, reg, reg}
+		node.Right.Accept(c, &chanData)
+		var ok int
+		if exprok && expr.regb > reg {
+			ok = 1
+		}
+		c.emitABC(OpRecv, reg, reg, ok, node.NodeInfo.Line)
+		if exprok && expr.regb > reg+1 {
+			c.emitAB(OpLoadnil, reg+2, expr.regb, node.NodeInfo.Line)
+		}
+		if exprok && expr.propagate {
+			expr.regb = reg
 		}
 	} else {
 		var op Opcode
@@ -911,6 +1386,46 @@ func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
 	}
 }
 
+// opcode of the arithmetic or comparison operator 'tok'
+func binaryOpcode(tok ast.Token) Opcode {
+	var op Opcode
+	switch tok {
+	case ast.TokenPlus:
+		op = OpAdd
+	case ast.TokenMinus:
+		op = OpSub
+	case ast.TokenTimes:
+		op = OpMul
+	case ast.TokenDiv:
+		op = OpDiv
+	case ast.TokenTimestimes:
+		op = OpPow
+	case ast.TokenMod:
+		op = OpMod
+	case ast.TokenIntdiv:
+		op = OpIntdiv
+	case ast.TokenLtlt:
+		op = OpShl
+	case ast.TokenGtgt:
+		op = OpShr
+	case ast.TokenAmp:
+		op = OpAnd
+	case ast.TokenPipe:
+		op = OpOr
+	case ast.TokenTilde:
+		op = OpXor
+	case ast.TokenLt, ast.TokenGt:
+		op = OpLt
+	case ast.TokenLteq, ast.TokenGteq:
+		op = OpLe
+	case ast.TokenEqeq:
+		op = OpEq
+	case ast.TokenBangeq:
+		op = OpNe
+	}
+	return op
+}
+
 func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
 	var reg int
 	expr, exprok := data.(*exprdata)
@@ -928,67 +1443,64 @@ func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
 		c.emitABx(OpLoadconst, reg, c.addConst(value), node.NodeInfo.Line)
 	} else {
 		if isAnd, isOr := node.Op == ast.TokenAmpamp, node.Op == ast.TokenPipepipe; isAnd || isOr {
+			propagate := exprok && expr.propagate
+			if _, ok := c.constFold(node.Left); ok {
+				// a constant left operand which doesn't decide the result
+				// (or it would be folded above), the result is the right one
+				rightData := exprdata{propagate, reg, reg}
+				node.Right.Accept(c, &rightData)
+				if propagate {
+					expr.regb = rightData.regb
+				}
+				return
+			}
+
 			var op Opcode
 			if isAnd {
 				op = OpJmpfalse
 			} else {
 				op = OpJmptrue
 			}
-			exprdata := exprdata{expr.propagate, reg, reg}
+
+			// the result is the operand which decides the expression, so
+			// both are evaluated in the same register, which must not be a
+			// variable that the right operand may still read (e.g. x = y && x)
+			res := reg
+			if res < c.block.register {
+				res = c.block.register
+				c.block.register++
+			}
+			exprdata := exprdata{false, res, res}
 			node.Left.Accept(c, &exprdata)
-			left := exprdata.regb
 
-			jmpInstr := c.emitAsBx(op, left, 0, node.NodeInfo.Line)
+			jmpInstr := c.emitAsBx(op, res, 0, node.NodeInfo.Line)
 			rightLabel := c.newLabel()
 
 			node.Right.Accept(c, &exprdata)
-			c.modifyAsBx(jmpInstr, op, left, c.labelOffset(rightLabel))
+			c.modifyAsBx(jmpInstr, op, res, c.labelOffset(rightLabel))
+			if res != reg {
+				c.block.register--
+				c.emitAB(OpMove, reg, res, c.lastLine)
+			}
+			if propagate {
+				expr.regb = reg
+			}
 			return
 		}
 
-		var op Opcode
-		switch node.Op {
-		case ast.TokenPlus:
-			op = OpAdd
-		case ast.TokenMinus:
-			op = OpSub
-		case ast.TokenTimes:
-			op = OpMul
-		case ast.TokenDiv:
-			op = OpDiv
-		case ast.TokenTimestimes:
-			op = OpPow
-		case ast.TokenLtlt:
-			op = OpShl
-		case ast.TokenGtgt:
-			op = OpShr
-		case ast.TokenAmp:
-			op = OpAnd
-		case ast.TokenPipe:
-			op = OpOr
-		case ast.TokenTilde:
-			op = OpXor
-		case ast.TokenLt, ast.TokenGteq:
-			op = OpLt
-		case ast.TokenLteq, ast.TokenGt:
-			op = OpLe
-		case ast.TokenEq:
-			op = OpEq
-		case ast.TokenBangeq:
-			op = OpNe
-		}
-
-		exprdata := exprdata{true, reg, 0}
+		op := binaryOpcode(node.Op)
+
+		exprdata := exprdata{true, reg, reg}
 		node.Left.Accept(c, &exprdata)
 		left := exprdata.regb
 
 		// temp register for right expression
-		exprdata.rega += 1
+		exprdata.rega, exprdata.regb = reg+1, reg+1
 		node.Right.Accept(c, &exprdata)
 		right := exprdata.regb
 
 		if node.Op == ast.TokenGt || node.Op == ast.TokenGteq {
-			// invert operands
+			// a > b is b < a and a >= b is b <= a
 			c.emitABC(op, reg, right, left, node.NodeInfo.Line)
 		} else {
 			c.emitABC(op, reg, left, right, node.NodeInfo.Line)
@@ -1026,6 +1538,11 @@ func (c *compiler) VisitDeclaration(node *ast.Declaration, data interface{}) {
 				c.error(node.NodeInfo.Line, fmt.Sprintf("const '%s' initializer is not a constant", id.Value))
 			}
 			c.block.addNameInfo(id.Value, &nameInfo{true, value, 0, kScopeLocal, c.block})
+			if c.topLevel() {
+				reg := c.block.register
+				c.emitABx(OpLoadconst, reg, c.addConst(value), node.NodeInfo.Line)
+				c.emitABx(OpSetglobal, reg, c.addConst(String(id.Value)), node.NodeInfo.Line)
+			}
 		}
 		return
 	}
@@ -1042,18 +1559,22 @@ func (c *compiler) VisitAssignment(node *ast.Assignment, data interface{}) {
 		c.declare(names, node.Right)
 		return
 	} else if node.Op != ast.TokenEq {
-		// compound assignment
-		// a += b -> a = a + b
-		bin := ast.BinaryExpr{Op: ast.CompoundOp(node.Op), Left: node.Left[0], Right: node.Right[0]}
-		fake := ast.Assignment{Op: ast.TokenEq, Left: node.Left, Right: []ast.Node{&bin}}
-		fake.Accept(c, nil)
+		// compound assignment, a += b -> a = a + b
+		// but evaluating the expression of 'a' only once
+		op := binaryOpcode(ast.CompoundOp(node.Op))
+		reg := c.block.register
+		c.readModifyWrite(node.Left[0], reg, func(value int) {
+			rightData := exprdata{true, reg + 3, reg + 3}
+			node.Right[0].Accept(c, &rightData)
+			c.emitABC(op, value, value, rightData.regb, node.NodeInfo.Line)
+		})
 		return
 	}
 
 	// regular assignment, if the left-side is an identifier
 	// then it has to be declared already
 	varCount, valueCount := len(node.Left), len(node.Right)
-	_, isCall := node.Right[valueCount-1].(*ast.CallExpr)
+	isCall := multipleValues(node.Right[valueCount-1])
 	_, isUnpack := node.Right[valueCount-1].(*ast.VarArg)
 	start := c.block.register
 	current := start
@@ -1086,15 +1607,23 @@ func (c *compiler) VisitAssignment(node *ast.Assignment, data interface{}) {
 }
 
 func (c *compiler) VisitBranchStmt(node *ast.BranchStmt, data interface{}) {
-	if !c.insideLoop() {
+	if node.Type == ast.TokenFallthrough {
+		// a valid fallthrough is handled by VisitSwitchStmt
+		c.error(node.NodeInfo.Line, "fallthrough statement out of place")
+	}
+	target := c.branchTarget(node.Type)
+	if target == nil && node.Type == ast.TokenBreak {
+		c.error(node.NodeInfo.Line, "break outside loop or switch")
+	} else if target == nil {
 		c.error(node.NodeInfo.Line, fmt.Sprintf("%s outside loop", node.Type))
 	}
+	c.leaveTryBlocks(target, node.NodeInfo.Line)
 	instr := c.emitAsBx(OpJmp, 0, 0, node.NodeInfo.Line)
 	switch node.Type {
 	case ast.TokenContinue:
-		c.block.loop.continues = append(c.block.loop.continues, uint32(instr))
+		target.loop.continues = append(target.loop.continues, uint32(instr))
 	case ast.TokenBreak:
-		c.block.loop.breaks = append(c.block.loop.breaks, uint32(instr))
+		target.loop.breaks = append(target.loop.breaks, uint32(instr))
 	}
 }
 
@@ -1105,11 +1634,68 @@ func (c *compiler) VisitReturnStmt(node *ast.ReturnStmt, data interface{}) {
 		data := exprdata{false, reg, reg}
 		v.Accept(c, &data)
 	}
+	c.leaveTryBlocks(c.block.funcBlock(), node.NodeInfo.Line)
 	c.emitAB(OpReturn, start, len(node.Values), node.NodeInfo.Line)
 }
 
 func (c *compiler) VisitPanicStmt(node *ast.PanicStmt, data interface{}) {
+	reg := c.block.register
+	errdata := exprdata{false, reg, reg}
+	node.Err.Accept(c, &errdata)
+	c.emitAB(OpPanic, reg, 0, node.NodeInfo.Line)
+}
+
+// the call is compiled as usual and then replaced by
+// 'op' (OpDefer or OpGo) with the same registers
+func (c *compiler) pendingCallHelper(call *ast.CallExpr, op Opcode, line int) {
+	reg := c.block.register
+	callData := exprdata{false, reg, reg}
+	call.Accept(c, &callData)
+
+	index := int(c.block.bytecode.NumCode - 1)
+	instr := c.block.bytecode.Code[index]
+	var method int
+	switch OpGetOpcode(instr) {
+	case OpCall:
+	case OpCallmethod:
+		method = 1
+	default:
+		c.error(line, fmt.Sprintf("expression in %s must be a function call", op))
+	}
+	c.modifyInstruction(index, OpNewABC(op, reg, method, int(OpGetC(instr))))
+}
+
+func (c *compiler) VisitDeferStmt(node *ast.DeferStmt, data interface{}) {
+	c.pendingCallHelper(node.Call, OpDefer, node.NodeInfo.Line)
+}
+
+func (c *compiler) VisitGoStmt(node *ast.GoStmt, data interface{}) {
+	c.pendingCallHelper(node.Call, OpGo, node.NodeInfo.Line)
+}
+
+// a function which yields is a generator, the values
+// of its return statements are discarded
+func (c *compiler) VisitYieldStmt(node *ast.YieldStmt, data interface{}) {
+	fn := c.block.funcBlock()
+	if fn.parent == nil {
+		c.error(node.NodeInfo.Line, "yield outside function")
+	}
+	fn.bytecode.Generator = true
+
+	reg := c.block.register
+	valueData := exprdata{false, reg, reg}
+	node.Value.Accept(c, &valueData)
+	c.emitAB(OpYield, reg, 0, node.NodeInfo.Line)
+}
+
+func (c *compiler) VisitSendStmt(node *ast.SendStmt, data interface{}) {
+	reg := c.block.register
+	chanData := exprdata{false, reg, reg}
+	node.Chan.Accept(c, &chanData)
 
+	valueData := exprdata{true, reg + 1, reg + 1}
+	node.Value.Accept(c, &valueData)
+	c.emitAB(OpSend, reg, valueData.regb, node.NodeInfo.Line)
 }
 
 func (c *compiler) VisitIfStmt(node *ast.IfStmt, data interface{}) {
@@ -1124,21 +1710,295 @@ func (c *compiler) VisitIfStmt(node *ast.IfStmt, data interface{}) {
 	c.branchConditionHelper(node.Cond, node.Body, node.Else, c.block.register)
 }
 
+// report whether the clause ends with a fallthrough
+func caseFallthrough(node *ast.CaseClause) bool {
+	nodes := node.Body.Nodes
+	if len(nodes) == 0 {
+		return false
+	}
+	branch, ok := nodes[len(nodes)-1].(*ast.BranchStmt)
+	return ok && branch.Type == ast.TokenFallthrough
+}
+
+// get the constant values of the cases if all of them are numbers
+// or strings, so the switch can be compiled to a jump table
+func (c *compiler) caseConstants(node *ast.SwitchStmt) ([][]Value, bool) {
+	if node.Tag == nil {
+		return nil, false
+	}
+	consts := make([][]Value, len(node.Cases))
+	seen := make(map[Value]bool)
+	for i, clause := range node.Cases {
+		for _, value := range clause.Values {
+			v, ok := c.constFold(value)
+			if !ok {
+				return nil, false
+			}
+			switch v.(type) {
+			case Number, String:
+			default:
+				return nil, false
+			}
+			if seen[v] {
+				c.error(clause.NodeInfo.Line, fmt.Sprintf("duplicate case %v in switch", v))
+			}
+			seen[v] = true
+			consts[i] = append(consts[i], v)
+		}
+	}
+	return consts, true
+}
+
+func (c *compiler) VisitCaseClause(node *ast.CaseClause, data interface{}) {
+	body := node.Body
+	if caseFallthrough(node) {
+		// the fallthrough itself is just the absence of the jump to the end
+		body = &ast.Block{Nodes: body.Nodes[:len(body.Nodes)-1], NodeInfo: body.NodeInfo}
+	}
+	c.blockHelper(body, kBlockContextBranch)
+}
+
+// switch tag { case a, b: ... default: ... } is compiled as:
+//
+//	eq       test, tag, a
+//	jmptrue  test, clause1
+//	eq       test, tag, b
+//	jmptrue  test, clause1
+//	jmp      default
+//	clause1:
+//	<body>
+//	jmp      end
+//	default:
+//	<body>
+//	end:
+//
+// if all the cases are constant numbers or strings, the tests
+// are replaced by a single OpSwitch with a jump table
+func (c *compiler) VisitSwitchStmt(node *ast.SwitchStmt, data interface{}) {
+	c.enterBlock(kBlockContextSwitch)
+	defer c.leaveBlock()
+
+	if node.Init != nil {
+		node.Init.Accept(c, nil)
+	}
+	tagReg := c.genRegister()
+	testReg := c.genRegister()
+	if node.Tag != nil {
+		tagData := exprdata{false, tagReg, tagReg}
+		node.Tag.Accept(c, &tagData)
+	}
+
+	type caseJump struct {
+		instr int
+		cond  int
+	}
+	jumps := make([][]caseJump, len(node.Cases))
+
+	var table JumpTable
+	var switchInstr int
+	consts, isTable := c.caseConstants(node)
+	if isTable {
+		bytecode := c.block.bytecode
+		table = make(JumpTable, len(consts))
+		switchInstr = c.emitABx(OpSwitch, tagReg, len(bytecode.JumpTables), node.NodeInfo.Line)
+		bytecode.JumpTables = append(bytecode.JumpTables, table)
+	} else {
+		for i, clause := range node.Cases {
+			for _, value := range clause.Values {
+				var cond int
+				if node.Tag != nil {
+					valueData := exprdata{true, testReg + 1, testReg + 1}
+					value.Accept(c, &valueData)
+					c.emitABC(OpEq, testReg, tagReg, valueData.regb, clause.NodeInfo.Line)
+					cond = testReg
+				} else {
+					condData := exprdata{true, testReg, testReg}
+					value.Accept(c, &condData)
+					cond = c.jumpCondition(condData.regb, testReg)
+				}
+				instr := c.emitAsBx(OpJmptrue, cond, 0, clause.NodeInfo.Line)
+				jumps[i] = append(jumps[i], caseJump{instr, cond})
+			}
+		}
+	}
+
+	// no case matched, go to the default clause or the end
+	defaultInstr := c.emitAsBx(OpJmp, 0, 0, node.NodeInfo.Line)
+	defaultLabel := -1
+	for i, clause := range node.Cases {
+		label := int(c.newLabel())
+		if clause.Values == nil {
+			defaultLabel = label
+		}
+		if isTable {
+			for _, v := range consts[i] {
+				table[v] = label - switchInstr - 1
+			}
+		}
+		for _, jump := range jumps[i] {
+			c.modifyAsBx(jump.instr, OpJmptrue, jump.cond, label-jump.instr-1)
+		}
+
+		if caseFallthrough(clause) && i == len(node.Cases)-1 {
+			c.error(clause.NodeInfo.Line, "cannot fallthrough final case in switch")
+		}
+		clause.Accept(c, nil)
+		if !caseFallthrough(clause) && i < len(node.Cases)-1 {
+			instr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+			c.block.loop.breaks = append(c.block.loop.breaks, uint32(instr))
+		}
+	}
+
+	c.block.loop.breakTarget = c.newLabel()
+	if defaultLabel < 0 {
+		defaultLabel = int(c.block.loop.breakTarget)
+	}
+	c.modifyAsBx(defaultInstr, OpJmp, 0, defaultLabel-defaultInstr-1)
+}
+
+// the received value and ok are in the registers data.rega and data.regb,
+// the clause assigns them if its case is an assignment
+func (c *compiler) VisitCommClause(node *ast.CommClause, data interface{}) {
+	expr := data.(*exprdata)
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+
+	if assign, ok := node.Comm.(*ast.Assignment); ok {
+		for i, left := range assign.Left {
+			if assign.Op == ast.TokenEq {
+				c.assignmentHelper(left, c.block.register, expr.rega+i)
+				continue
+			}
+			id, ok := left.(*ast.Id)
+			if !ok {
+				c.error(node.NodeInfo.Line, "non-name on left side of :=")
+			}
+			reg := c.genRegister()
+			c.emitAB(OpMove, reg, expr.rega+i, node.NodeInfo.Line)
+			c.declareLocalVar(id.Value, reg)
+		}
+	}
+	node.Body.Accept(c, nil)
+}
+
+// select { case v := <-a: ... case b <- x: ... default: ... } is compiled as:
+//
+//	<a into chan1>
+//	<b into chan2, x into value2>
+//	select    result, "rsd"
+//	switch    result, 0->clause1 1->clause2
+//	jmp       default
+//	clause1:
+//	<v := received>
+//	<body>
+//	jmp       end
+//	clause2:
+//	<body>
+//	jmp       end
+//	default:
+//	<body>
+//	end:
+//
+// the channels and the values to send are evaluated in order
+// before the select, see OpSelect for its registers
+func (c *compiler) VisitSelectStmt(node *ast.SelectStmt, data interface{}) {
+	c.enterBlock(kBlockContextSwitch)
+	defer c.leaveBlock()
+
+	resultReg := c.genRegister()
+	c.genRegister() // received value
+	c.genRegister() // ok
+
+	var desc []byte
+	for _, clause := range node.Cases {
+		if clause.Comm == nil {
+			continue
+		}
+		chanReg := c.genRegister()
+		valueReg := c.genRegister()
+
+		var ch, value ast.Node
+		switch comm := clause.Comm.(type) {
+		case *ast.SendStmt:
+			ch, value = comm.Chan, comm.Value
+		case *ast.Assignment:
+			ch = comm.Right[0].(*ast.UnaryExpr).Right
+		case *ast.UnaryExpr:
+			ch = comm.Right
+		}
+		chanData := exprdata{false, chanReg, chanReg}
+		ch.Accept(c, &chanData)
+		if value != nil {
+			valueData := exprdata{false, valueReg, valueReg}
+			value.Accept(c, &valueData)
+			desc = append(desc, 's')
+		} else {
+			desc = append(desc, 'r')
+		}
+	}
+
+	hasDefault := len(desc) < len(node.Cases)
+	if hasDefault {
+		desc = append(desc, 'd')
+	}
+	c.emitABx(OpSelect, resultReg, c.addConst(String(desc)), node.NodeInfo.Line)
+
+	bytecode := c.block.bytecode
+	table := make(JumpTable, len(node.Cases))
+	switchInstr := c.emitABx(OpSwitch, resultReg, len(bytecode.JumpTables), node.NodeInfo.Line)
+	bytecode.JumpTables = append(bytecode.JumpTables, table)
+
+	// the default case is chosen when the result is -1
+	defaultInstr := c.emitAsBx(OpJmp, 0, 0, node.NodeInfo.Line)
+	defaultLabel := -1
+	var index int
+	for i, clause := range node.Cases {
+		label := int(c.newLabel())
+		if clause.Comm == nil {
+			defaultLabel = label
+		} else {
+			table[Number(index)] = label - switchInstr - 1
+			index++
+		}
+
+		clause.Accept(c, &exprdata{false, resultReg + 1, resultReg + 2})
+		if i < len(node.Cases)-1 {
+			instr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+			c.block.loop.breaks = append(c.block.loop.breaks, uint32(instr))
+		}
+	}
+
+	c.block.loop.breakTarget = c.newLabel()
+	if defaultLabel < 0 {
+		defaultLabel = int(c.block.loop.breakTarget)
+	}
+	c.modifyAsBx(defaultInstr, OpJmp, 0, defaultLabel-defaultInstr-1)
+}
+
+// for k, v in collection when cond is compiled as:
+//
+//	forbegin  state, collection
+//	test:
+//	foriter   state, collection, k
+//	jmp       end
+//	jmpfalse  cond, test
+//	<body>
+//	close     state       ; only if a closure captures the variables
+//	jmp       test
+//	end:
 func (c *compiler) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interface{}) {
 	c.enterBlock(kBlockContextLoop)
 	defer c.leaveBlock()
 
-	arrReg := c.genRegister()
-	lenReg := c.genRegister()
+	stateReg := c.genRegister()
+	c.genRegister() // iteration index
+	colReg := c.genRegister()
 	keyReg := c.genRegister()
-	idxReg := c.genRegister()
 	valReg := c.genRegister()
-	colReg := c.genRegister()
 
 	collectionData := exprdata{false, colReg, colReg}
 	node.Collection.Accept(c, &collectionData)
-	c.emitAB(OpForbegin, arrReg, colReg, node.NodeInfo.Line)
-	c.emitABx(OpLoadconst, idxReg, c.addConst(Number(0)), c.lastLine)
+	c.emitAB(OpForbegin, stateReg, colReg, node.NodeInfo.Line)
 
 	if node.Value == nil {
 		c.declareLocalVar(node.Key.Value, valReg)
@@ -1148,20 +2008,29 @@ func (c *compiler) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interfac
 	}
 
 	testLabel := c.newLabel()
-	testReg := c.block.register
-	c.emitABC(OpLt, testReg, idxReg, lenReg, c.lastLine)
-	jmpInstr := c.emitAsBx(OpJmpfalse, testReg, 0, c.lastLine)
+	c.emitABC(OpForiter, stateReg, colReg, keyReg, node.NodeInfo.Line)
+	jmpInstr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
 
-	c.emitABC(OpForiter, keyReg, colReg, arrReg, node.NodeInfo.Line)
-	c.emitABC(OpGetIndex, valReg, colReg, keyReg, c.lastLine)
+	if node.When != nil {
+		reg := c.block.register
+		whenData := exprdata{true, reg, reg}
+		node.When.Accept(c, &whenData)
+		cond := c.jumpCondition(whenData.regb, reg)
+		c.emitAsBx(OpJmpfalse, cond, -c.labelOffset(testLabel)-1, c.lastLine)
+	}
 
 	node.Body.Accept(c, nil)
-	c.block.loop.continueTarget = c.newLabel()
+	c.block.loop.continueTarget = testLabel
+	if c.block.captured {
+		// each iteration has its own variables
+		c.block.loop.continueTarget = c.newLabel()
+		c.closeBlock(c.block)
+	}
 
 	c.emitAsBx(OpJmp, 0, -c.labelOffset(testLabel)-1, c.lastLine)
 	c.block.loop.breakTarget = c.newLabel()
 
-	c.modifyAsBx(jmpInstr, OpJmpfalse, testReg, c.labelOffset(uint32(jmpInstr)+1))
+	c.modifyAsBx(jmpInstr, OpJmp, 0, c.labelOffset(uint32(jmpInstr)+1))
 }
 
 func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
@@ -1182,18 +2051,20 @@ func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
 		condData := exprdata{true, reg, reg}
 		node.Cond.Accept(c, &condData)
 
-		cond = condData.regb
+		cond = c.jumpCondition(condData.regb, reg)
 		jmpInstr = c.emitAsBx(OpJmpfalse, cond, 0, c.lastLine)
 		jmpLabel = c.newLabel()
 	}
 
 	node.Body.Accept(c, nil)
 	c.block.loop.continueTarget = c.newLabel()
+	// each iteration has its own variables
+	c.closeBlock(c.block)
 
 	if node.Step != nil {
 		node.Step.Accept(c, nil)
 		c.block.register -= 1 // discard register consumed by Step
-	} else {
+	} else if !c.block.captured {
 		c.block.loop.continueTarget = startLabel // saves one jump
 	}
 
@@ -1206,11 +2077,92 @@ func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
 }
 
 func (c *compiler) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
-
+	// the panicked value is already in the register given by 'data'
+	expr, _ := data.(*exprdata)
+	if node.Id != nil {
+		c.declareLocalVar(node.Id.Value, expr.rega)
+	}
+	node.Block.Accept(c, nil)
 }
 
+// try, recover and finally are compiled as:
+//
+//	trybegin  err, handler
+//	<try>
+//	tryend
+//	<finally>
+//	jmp       end
+//	handler:
+//	trybegin  err2, handler2   ; only with a finally
+//	<recover>                  ; or a rethrow of err if there's no recover
+//	tryend
+//	<finally>
+//	jmp       end
+//	handler2:
+//	<finally>
+//	panic     err2, 1
+//	end:
+//
+// leaving any of the blocks with return, break or continue
+// also runs the finally block (see leaveTryBlocks), and the
+// handlers close the upvalues of the block which panicked
 func (c *compiler) VisitTryRecoverStmt(node *ast.TryRecoverStmt, data interface{}) {
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+
+	var endJumps []int
+	line := node.NodeInfo.Line
+	errReg := c.genRegister()
+	tryInstr := c.emitAsBx(OpTrybegin, errReg, 0, line)
+	tryLabel := c.newLabel()
+
+	c.enterBlock(kBlockContextTry)
+	c.block.finally = node.Finally
+	tryBlock := c.block
+	node.Try.Accept(c, nil)
+	c.leaveBlock()
+
+	c.emitAB(OpTryend, 0, 0, c.lastLine)
+	if node.Finally != nil {
+		c.blockHelper(node.Finally, kBlockContextBranch)
+	}
+	endJumps = append(endJumps, c.emitAsBx(OpJmp, 0, 0, c.lastLine))
+	c.modifyAsBx(tryInstr, OpTrybegin, errReg, c.labelOffset(tryLabel))
+	// a panic leaves the try block without reaching its end
+	c.closeBlock(tryBlock)
+
+	if node.Recover == nil {
+		// only finally, run it and keep panicking
+		c.blockHelper(node.Finally, kBlockContextBranch)
+		c.emitAB(OpPanic, errReg, 1, c.lastLine)
+	} else if node.Finally == nil {
+		c.enterBlock(kBlockContextBranch)
+		node.Recover.Accept(c, &exprdata{false, errReg, errReg})
+		c.leaveBlock()
+	} else {
+		finallyReg := c.genRegister()
+		recoverInstr := c.emitAsBx(OpTrybegin, finallyReg, 0, node.Recover.NodeInfo.Line)
+		recoverLabel := c.newLabel()
 
+		c.enterBlock(kBlockContextTry)
+		c.block.finally = node.Finally
+		recoverBlock := c.block
+		node.Recover.Accept(c, &exprdata{false, errReg, errReg})
+		c.leaveBlock()
+
+		c.emitAB(OpTryend, 0, 0, c.lastLine)
+		c.blockHelper(node.Finally, kBlockContextBranch)
+		endJumps = append(endJumps, c.emitAsBx(OpJmp, 0, 0, c.lastLine))
+		c.modifyAsBx(recoverInstr, OpTrybegin, finallyReg, c.labelOffset(recoverLabel))
+		c.closeBlock(recoverBlock)
+
+		c.blockHelper(node.Finally, kBlockContextBranch)
+		c.emitAB(OpPanic, finallyReg, 1, c.lastLine)
+	}
+
+	for _, index := range endJumps {
+		c.modifyAsBx(index, OpJmp, 0, c.labelOffset(uint32(index)+1))
+	}
 }
 
 func (c *compiler) VisitBlock(node *ast.Block, data interface{}) {
@@ -1242,6 +2194,7 @@ func Compile(root ast.Node, filename string) (res *Bytecode, err error) {
 	var c compiler
 	c.filename = filename
 	c.mainFunc = newBytecode(filename)
+	c.mainFunc.Name = "main"
 	c.block = newCompilerBlock(c.mainFunc, kBlockContextFunc, nil)
 
 	root.Accept(&c, nil)
@@ -0,0 +1,536 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// conversions between script values and Go values.
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var (
+	valueType  = reflect.TypeOf((*Value)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	goFuncType = reflect.TypeOf(GoFunc(nil))
+	chanType   = reflect.TypeOf(Chan(nil))
+)
+
+// TypeError reports a value which can't be converted to a Go type,
+// or a Go type which can't be converted to a value.
+type TypeError struct {
+	Path  string       // the part of a nested value which failed, like "field x: element 2"
+	Value Value        // the value converted to Type, nil when converting from Type
+	Type  reflect.Type // the Go type
+}
+
+func (e *TypeError) Error() string {
+	if e.Value == nil {
+		return withPath(e.Path, fmt.Sprintf("cannot convert %s to a value", e.Type))
+	}
+
+	desc := e.Value.Type().String()
+	switch e.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if e.Value.Type() == ValueNumber {
+			desc = e.Value.String()
+		}
+	case reflect.Array:
+		if arr, ok := e.Value.(*Array); ok {
+			desc = fmt.Sprintf("array of length %d", len(*arr))
+		}
+	}
+	return withPath(e.Path, fmt.Sprintf("cannot use %s as %s", desc, e.Type))
+}
+
+// CycleError reports an array, object or Go value which contains
+// itself where it can't be converted.
+type CycleError struct {
+	Path string // the part of the value which refers back to its container
+}
+
+func (e *CycleError) Error() string {
+	return withPath(e.Path, "cannot convert a cyclic value")
+}
+
+// add the part 'at' of a nested value to the path of the conversion error 'err'
+func inside(err error, at string) error {
+	switch e := err.(type) {
+	case *TypeError:
+		e.Path = withPath(at, e.Path)
+	case *CycleError:
+		e.Path = withPath(at, e.Path)
+	}
+	return err
+}
+
+// join the parts of an error message which aren't empty
+func withPath(path, msg string) string {
+	switch {
+	case path == "":
+		return msg
+	case msg == "":
+		return path
+	}
+	return path + ": " + msg
+}
+
+// ToValue converts the Go value 'x' to a script value. Booleans, numbers
+// and strings convert to the corresponding values, slices and arrays to
+// arrays, maps with string keys and structs to objects, and functions
+// to host functions like the ones of VM.DefineFunc. Pointers and
+// interfaces convert to the values they point to, or to nil.
+//
+// The exported fields of a struct have the same names in the object,
+// unless a tag like `yo:"name"` renames it, the tag `yo:"-"` leaves it
+// out, and the fields of an embedded struct are promoted like in Go.
+func ToValue(x interface{}) (Value, error) {
+	e := encoder{seen: make(map[seenKey]bool)}
+	return e.encode(reflect.ValueOf(x))
+}
+
+// ExportTo converts the value 'v' to the Go value pointed to by 'target',
+// like json.Unmarshal the fields of a struct which aren't in the object
+// are left as they are, and nil pointers and maps are allocated when
+// needed. The conversions are the reverse of ToValue's, numbers must be
+// integers to convert to the integer types, and interface{} takes the
+// value returned by Export.
+func ExportTo(v Value, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("ExportTo expects a non-nil pointer, got %T", target)
+	}
+	d := decoder{seen: make(map[interface{}]bool)}
+	return d.decode(v, rv.Elem())
+}
+
+// DefineFunc defines the global 'name' as the Go function 'fn', which can
+// have any signature. The arguments of the script are converted to the
+// types of its parameters like by ExportTo, and its results back to
+// values like by ToValue, except for a last result of type error, which
+// fails the call when it's not nil.
+func (vm *VM) DefineFunc(name string, fn interface{}) {
+	vm.Define(name, wrapFunc(name, reflect.ValueOf(fn)))
+}
+
+// make a host function which calls the Go function 'fn', named 'name' in the errors
+func wrapFunc(name string, fn reflect.Value) GoFunc {
+	t := fn.Type()
+	if t.Kind() != reflect.Func {
+		panic(fmt.Sprintf("yo: %s is a %s, not a function", name, t))
+	}
+	numIn := t.NumIn()
+	numOut := t.NumOut()
+	returnsError := numOut > 0 && t.Out(numOut-1) == errorType
+
+	return func(call *FuncCall) {
+		n := int(call.NumArgs)
+		switch {
+		case t.IsVariadic() && n < numIn-1:
+			call.Error("%s expects at least %s, got %d", name, arguments(numIn-1), n)
+			return
+		case !t.IsVariadic() && n != numIn:
+			call.Error("%s expects %s, got %d", name, arguments(numIn), n)
+			return
+		}
+
+		args := make([]reflect.Value, n)
+		for i := range args {
+			var at reflect.Type
+			if t.IsVariadic() && i >= numIn-1 {
+				at = t.In(numIn - 1).Elem()
+			} else {
+				at = t.In(i)
+			}
+			args[i] = reflect.New(at).Elem()
+			d := decoder{seen: make(map[interface{}]bool)}
+			if err := d.decode(call.Args[i], args[i]); err != nil {
+				call.Error("%s: argument %d: %s", name, i+1, err)
+				return
+			}
+		}
+
+		out := fn.Call(args)
+		if returnsError {
+			if err, _ := out[numOut-1].Interface().(error); err != nil {
+				call.Error("%s", err)
+				return
+			}
+			out = out[:numOut-1]
+		}
+		for i, res := range out {
+			e := encoder{seen: make(map[seenKey]bool)}
+			v, err := e.encode(res)
+			if err != nil {
+				call.Error("%s: result %d: %s", name, i+1, err)
+				return
+			}
+			call.PushReturnValue(v)
+		}
+	}
+}
+
+// a field of a struct as seen by the scripts
+type structField struct {
+	name  string
+	index []int
+}
+
+// get the fields of the struct type 't' which the scripts see, the
+// fields of embedded structs come after the ones they don't shadow
+func fieldsOf(t reflect.Type) []structField {
+	var fields, promoted []structField
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("yo")
+		switch {
+		case tag == "-":
+		case f.Anonymous && f.Type.Kind() == reflect.Struct && tag == "":
+			for _, ef := range fieldsOf(f.Type) {
+				index := append([]int{i}, ef.index...)
+				promoted = append(promoted, structField{ef.name, index})
+			}
+		case f.PkgPath == "":
+			if tag == "" {
+				tag = f.Name
+			}
+			fields = append(fields, structField{tag, f.Index})
+			names[tag] = true
+		}
+	}
+	for _, f := range promoted {
+		if !names[f.name] {
+			fields = append(fields, f)
+			names[f.name] = true
+		}
+	}
+	return fields
+}
+
+// the converter of Go values to values
+type encoder struct {
+	seen map[seenKey]bool // the pointers, maps and slices being converted
+}
+
+type seenKey struct {
+	ptr uintptr
+	len int
+	t   reflect.Type
+}
+
+func (e *encoder) encode(rv reflect.Value) (Value, error) {
+	if !rv.IsValid() {
+		return Nil{}, nil
+	}
+	t := rv.Type()
+	if t.Implements(valueType) {
+		if (rv.Kind() == reflect.Interface || rv.Kind() == reflect.Ptr) && rv.IsNil() {
+			return Nil{}, nil
+		}
+		return rv.Interface().(Value), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return Bool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Number(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return Number(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return Number(rv.Float()), nil
+	case reflect.String:
+		return String(rv.String()), nil
+	case reflect.Slice:
+		if rv.IsNil() {
+			return Nil{}, nil
+		}
+		key := seenKey{rv.Pointer(), rv.Len(), t}
+		if e.seen[key] {
+			return nil, &CycleError{}
+		}
+		e.seen[key] = true
+		defer delete(e.seen, key)
+		return e.encodeElems(rv)
+	case reflect.Array:
+		return e.encodeElems(rv)
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return Nil{}, nil
+		}
+		key := seenKey{rv.Pointer(), 0, t}
+		if e.seen[key] {
+			return nil, &CycleError{}
+		}
+		e.seen[key] = true
+		defer delete(e.seen, key)
+
+		fields := make(map[string]Value, rv.Len())
+		for _, k := range rv.MapKeys() {
+			v, err := e.encode(rv.MapIndex(k))
+			if err != nil {
+				return nil, inside(err, "field "+k.String())
+			}
+			fields[k.String()] = v
+		}
+		return NewObject(nil, fields), nil
+	case reflect.Struct:
+		sf := typeInfoOf(t).fields
+		fields := make(map[string]Value, len(sf))
+		for _, f := range sf {
+			v, err := e.encode(rv.FieldByIndex(f.index))
+			if err != nil {
+				return nil, inside(err, "field "+f.name)
+			}
+			fields[f.name] = v
+		}
+		return NewObject(nil, fields), nil
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return Nil{}, nil
+		}
+		key := seenKey{rv.Pointer(), 0, t}
+		if e.seen[key] {
+			return nil, &CycleError{}
+		}
+		e.seen[key] = true
+		defer delete(e.seen, key)
+		return e.encode(rv.Elem())
+	case reflect.Interface:
+		if rv.IsNil() {
+			return Nil{}, nil
+		}
+		return e.encode(rv.Elem())
+	case reflect.Func:
+		if rv.IsNil() {
+			return Nil{}, nil
+		}
+		if t.ConvertibleTo(goFuncType) {
+			return rv.Convert(goFuncType).Interface().(Value), nil
+		}
+		return wrapFunc(goName(rv), rv), nil
+	case reflect.Chan:
+		if t.ConvertibleTo(chanType) {
+			return rv.Convert(chanType).Interface().(Value), nil
+		}
+	}
+	return nil, &TypeError{Type: t}
+}
+
+func (e *encoder) encodeElems(rv reflect.Value) (Value, error) {
+	arr := make(Array, rv.Len())
+	for i := range arr {
+		v, err := e.encode(rv.Index(i))
+		if err != nil {
+			return nil, inside(err, fmt.Sprintf("element %d", i))
+		}
+		arr[i] = v
+	}
+	return &arr, nil
+}
+
+// the converter of values to Go values
+type decoder struct {
+	seen map[interface{}]bool // the arrays and objects being converted
+}
+
+// convert the value 'v' to the Go value 'rv', which must be settable
+func (d *decoder) decode(v Value, rv reflect.Value) error {
+	t := rv.Type()
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		if x := v.Export(); x != nil {
+			rv.Set(reflect.ValueOf(x))
+		} else {
+			rv.Set(reflect.Zero(t))
+		}
+		return nil
+	}
+	if reflect.TypeOf(v).AssignableTo(t) {
+		rv.Set(reflect.ValueOf(v))
+		return nil
+	}
+	if g, ok := v.(*GoObject); ok && g.ptr.IsValid() {
+		// the wrapped Go value itself, or a copy of it
+		switch {
+		case g.ptr.Type().AssignableTo(t):
+			rv.Set(g.ptr)
+			return nil
+		case g.ptr.Type().Elem().AssignableTo(t):
+			rv.Set(g.ptr.Elem())
+			return nil
+		}
+		if k := g.goKind(); k == reflect.Slice || k == reflect.Map {
+			// the elements of a wrapped slice or map are converted one by one
+			e := encoder{seen: make(map[seenKey]bool)}
+			elems, err := e.encode(g.ptr.Elem())
+			if err != nil {
+				return err
+			}
+			return d.decode(elems, rv)
+		}
+	}
+
+	mismatch := &TypeError{Value: v, Type: t}
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := v.assertBool()
+		if !ok {
+			return mismatch
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.assertFloat64()
+		if !ok || !isInt(n) || n < math.MinInt64 || n >= math.MaxInt64 || rv.OverflowInt(int64(n)) {
+			return mismatch
+		}
+		rv.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := v.assertFloat64()
+		if !ok || !isInt(n) || n < 0 || n >= math.MaxUint64 || rv.OverflowUint(uint64(n)) {
+			return mismatch
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		n, ok := v.assertFloat64()
+		if !ok {
+			return mismatch
+		}
+		rv.SetFloat(n)
+	case reflect.String:
+		s, ok := v.assertString()
+		if !ok {
+			return mismatch
+		}
+		rv.SetString(s)
+	case reflect.Slice:
+		if v.Type() == ValueNil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		arr, ok := v.(*Array)
+		if !ok {
+			return mismatch
+		}
+		rv.Set(reflect.MakeSlice(t, len(*arr), len(*arr)))
+		return d.decodeElems(arr, rv)
+	case reflect.Array:
+		arr, ok := v.(*Array)
+		if !ok || len(*arr) != t.Len() {
+			return mismatch
+		}
+		return d.decodeElems(arr, rv)
+	case reflect.Map:
+		if v.Type() == ValueNil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		obj, ok := toObject(v)
+		if !ok || t.Key().Kind() != reflect.String {
+			return mismatch
+		}
+		if err := d.enter(obj); err != nil {
+			return err
+		}
+		defer delete(d.seen, obj)
+
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(t, len(obj.Fields)))
+		}
+		for k, field := range obj.Fields {
+			fv := reflect.New(t.Elem()).Elem()
+			if err := d.decode(field, fv); err != nil {
+				return inside(err, "field "+k)
+			}
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), fv)
+		}
+	case reflect.Struct:
+		obj, ok := toObject(v)
+		if !ok {
+			return mismatch
+		}
+		if err := d.enter(obj); err != nil {
+			return err
+		}
+		defer delete(d.seen, obj)
+
+		for _, f := range typeInfoOf(t).fields {
+			field, ok := obj.Get(f.name)
+			if !ok {
+				continue
+			}
+			if err := d.decode(field, rv.FieldByIndex(f.index)); err != nil {
+				return inside(err, "field "+f.name)
+			}
+		}
+	case reflect.Ptr:
+		if v.Type() == ValueNil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.New(t.Elem()))
+		}
+		return d.decode(v, rv.Elem())
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+func (d *decoder) decodeElems(arr *Array, rv reflect.Value) error {
+	if err := d.enter(arr); err != nil {
+		return err
+	}
+	defer delete(d.seen, arr)
+
+	for i, elem := range *arr {
+		if err := d.decode(elem, rv.Index(i)); err != nil {
+			return inside(err, fmt.Sprintf("element %d", i))
+		}
+	}
+	return nil
+}
+
+// mark the array or object 'v' as being converted, it's
+// a cycle if it's already being converted
+func (d *decoder) enter(v interface{}) error {
+	if d.seen[v] {
+		return &CycleError{}
+	}
+	d.seen[v] = true
+	return nil
+}
+
+// convert the value 'v' to the natural Go value, see Value.Export, the
+// arrays and objects already converted in 'seen' are reused for cycles
+func exportValue(v Value, seen map[interface{}]interface{}) interface{} {
+	switch v := v.(type) {
+	case *Array:
+		if x, ok := seen[v]; ok {
+			return x
+		}
+		res := make([]interface{}, len(*v))
+		seen[v] = res
+		for i, elem := range *v {
+			res[i] = exportValue(elem, seen)
+		}
+		return res
+	case *Object:
+		if x, ok := seen[v]; ok {
+			return x
+		}
+		res := make(map[string]interface{}, len(v.Fields))
+		seen[v] = res
+		for k, field := range v.Fields {
+			res[k] = exportValue(field, seen)
+		}
+		return res
+	}
+	return v.Export()
+}
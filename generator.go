@@ -0,0 +1,81 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// generators.
+//
+// Calling a function which yields makes its frame without running it,
+// the frame lives in the Generator out of the call stack. Resuming the
+// generator pushes the frame on top of the stack of the goroutine which
+// resumes it, and yield takes it out again, so the function runs in the
+// same loop as its caller and it can wait in channel operations and
+// give way to the other goroutines like any other function.
+
+// Next runs the generator until it yields a value, ok is false
+// if the function returns instead, or if it already returned.
+func (g *Generator) Next() (v Value, ok bool, err error) {
+	if g.done {
+		return Nil{}, false, nil
+	}
+	vm := g.vm
+	base := vm.calls.sp
+	if !g.resume(vm) {
+		err, vm.error = vm.error, nil
+		return Nil{}, false, err
+	}
+	if err := vm.run(base); err != nil {
+		return Nil{}, false, err
+	}
+	v, ok = g.take()
+	return v, ok, nil
+}
+
+// push the frame of the generator so it runs until it yields or returns
+func (g *Generator) resume(vm *VM) bool {
+	if g.running {
+		vm.setError("generator is already running")
+		return false
+	}
+	if vm.calls.sp >= CallStackSize {
+		vm.setError("stack overflow")
+		return false
+	}
+	g.running = true
+	g.spare = vm.calls.push(g.frame)
+	vm.currentFrame = g.frame
+	return true
+}
+
+// suspend the generator with the value 'v', its frame is taken
+// out of the stack and the execution continues in the caller
+func (g *Generator) yield(vm *VM, v Value) {
+	g.value, g.ready = v, true
+	g.running = false
+	vm.calls.detach(g.spare)
+	g.spare = nil
+	vm.currentFrame = vm.calls.Last()
+}
+
+// get the value yielded, if any
+func (g *Generator) take() (Value, bool) {
+	if !g.ready {
+		return Nil{}, false
+	}
+	v := g.value
+	g.value, g.ready = nil, false
+	return v, true
+}
+
+// pop the last frame of the stack, a generator which was running
+// in it finishes, because it returned or failed
+func (vm *VM) popFrame() *callFrame {
+	cf := vm.calls.Last()
+	g := cf.gen
+	if g == nil {
+		return vm.calls.Pop()
+	}
+	vm.calls.detach(g.spare)
+	g.spare, g.frame = nil, nil
+	g.running, g.done = false, true
+	return cf
+}
@@ -0,0 +1,249 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// objects which give the scripts access to Go values.
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// the reflection metadata of a Go type, see typeInfoOf
+type typeInfo struct {
+	fields  []structField  // the fields of the struct, or of the struct pointed to
+	byName  map[string]int // the index in fields of each name
+	methods map[string]int // the index of each method in the method set
+}
+
+var typeCache struct {
+	sync.RWMutex
+	types map[reflect.Type]*typeInfo
+}
+
+// get the metadata of the type 't', it's computed
+// once for each type and shared by all the VMs
+func typeInfoOf(t reflect.Type) *typeInfo {
+	typeCache.RLock()
+	info, ok := typeCache.types[t]
+	typeCache.RUnlock()
+	if ok {
+		return info
+	}
+
+	info = &typeInfo{byName: make(map[string]int), methods: make(map[string]int)}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() == reflect.Struct {
+		info.fields = fieldsOf(st)
+		for i, f := range info.fields {
+			info.byName[f.name] = i
+		}
+	}
+	for i := 0; i < t.NumMethod(); i++ {
+		info.methods[t.Method(i).Name] = i
+	}
+
+	typeCache.Lock()
+	if typeCache.types == nil {
+		typeCache.types = make(map[reflect.Type]*typeInfo)
+	}
+	typeCache.types[t] = info
+	typeCache.Unlock()
+	return info
+}
+
+// WrapObject makes an object which gives the scripts access to the Go
+// value pointed to by 'ptr'. They read and write its exported fields,
+// named like by ToValue, and call its methods, which take and return
+// values like the functions of DefineFunc. The fields which are structs,
+// pointers to structs, slices or maps with string keys are wrapped as well,
+// so the scripts index, append to and iterate over the Go values themselves,
+// the others are converted each time they're read, and the keys which
+// aren't fields or methods are kept by the object like by a regular one.
+func (vm *VM) WrapObject(ptr interface{}) *GoObject {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		panic(fmt.Sprintf("yo: WrapObject expects a non-nil pointer, got %T", ptr))
+	}
+	return wrapPointer(rv)
+}
+
+func wrapPointer(ptr reflect.Value) *GoObject {
+	obj := NewGoObject(nil, make(map[string]Value), ptr.Interface())
+	obj.ptr = ptr
+	obj.info = typeInfoOf(ptr.Type())
+	return obj
+}
+
+// convert the Go value 'rv' to a value, the structs, slices and maps
+// which can be changed in place are wrapped instead of copied
+func goValue(rv reflect.Value) (Value, error) {
+	switch {
+	case rv.Type().Implements(valueType):
+	case rv.Kind() == reflect.Struct && rv.CanAddr():
+		return wrapPointer(rv.Addr()), nil
+	case rv.Kind() == reflect.Ptr && rv.Type().Elem().Kind() == reflect.Struct && !rv.IsNil():
+		return wrapPointer(rv), nil
+	case rv.Kind() == reflect.Slice && rv.CanAddr() && !rv.IsNil():
+		return wrapPointer(rv.Addr()), nil
+	case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String && rv.CanAddr() && !rv.IsNil():
+		return wrapPointer(rv.Addr()), nil
+	}
+	e := encoder{seen: make(map[seenKey]bool)}
+	return e.encode(rv)
+}
+
+// the kind of the wrapped Go value, reflect.Invalid if there's none
+func (v *GoObject) goKind() reflect.Kind {
+	if !v.ptr.IsValid() {
+		return reflect.Invalid
+	}
+	return v.ptr.Elem().Kind()
+}
+
+// the number of elements of the wrapped slice or map,
+// or the number of fields of the wrapped struct
+func (v *GoObject) goLen() int {
+	switch v.goKind() {
+	case reflect.Slice, reflect.Map:
+		return v.ptr.Elem().Len()
+	case reflect.Struct:
+		return len(v.info.fields)
+	}
+	return 0
+}
+
+// the keys of the wrapped map, or the names of the fields of the wrapped struct
+func (v *GoObject) goKeys() []string {
+	switch v.goKind() {
+	case reflect.Map:
+		keys := v.ptr.Elem().MapKeys()
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = k.String()
+		}
+		return names
+	case reflect.Struct:
+		names := make([]string, len(v.info.fields))
+		for i, f := range v.info.fields {
+			names[i] = f.name
+		}
+		return names
+	}
+	return nil
+}
+
+// get the element 'index' of the wrapped slice
+func (v *GoObject) getElem(vm *VM, index Value) (Value, bool) {
+	s := v.ptr.Elem()
+	i, ok := sequenceIndex(vm, "slice", s.Len(), index)
+	if !ok {
+		return nil, false
+	}
+	res, err := goValue(s.Index(i))
+	if err != nil {
+		vm.setError("%s", inside(err, fmt.Sprintf("element %d", i)))
+		return nil, false
+	}
+	return res, true
+}
+
+// set the element 'index' of the wrapped slice
+func (v *GoObject) setElem(vm *VM, index Value, value Value) bool {
+	s := v.ptr.Elem()
+	i, ok := sequenceIndex(vm, "slice", s.Len(), index)
+	if !ok {
+		return false
+	}
+	res := reflect.New(s.Type().Elem()).Elem()
+	d := decoder{seen: make(map[interface{}]bool)}
+	if err := d.decode(value, res); err != nil {
+		vm.setError("%s", inside(err, fmt.Sprintf("element %d", i)))
+		return false
+	}
+	s.Index(i).Set(res)
+	return true
+}
+
+// append the values to the wrapped slice
+func (v *GoObject) appendElems(values []Value) error {
+	s := v.ptr.Elem()
+	d := decoder{seen: make(map[interface{}]bool)}
+	for i, value := range values {
+		res := reflect.New(s.Type().Elem()).Elem()
+		if err := d.decode(value, res); err != nil {
+			return inside(err, fmt.Sprintf("argument %d", i+2))
+		}
+		s = reflect.Append(s, res)
+	}
+	v.ptr.Elem().Set(s)
+	return nil
+}
+
+// get the field or method 'key' of the wrapped Go value, the
+// bool result is false if it has none with that name
+func (v *GoObject) getGo(key string) (Value, bool, error) {
+	if !v.ptr.IsValid() {
+		return nil, false, nil
+	}
+	if v.goKind() == reflect.Map {
+		elem := v.ptr.Elem().MapIndex(reflect.ValueOf(key).Convert(v.ptr.Type().Elem().Key()))
+		if !elem.IsValid() {
+			return nil, false, nil
+		}
+		res, err := goValue(elem)
+		return res, true, inside(err, "field "+key)
+	}
+	if i, ok := v.info.byName[key]; ok {
+		res, err := goValue(v.ptr.Elem().FieldByIndex(v.info.fields[i].index))
+		return res, true, inside(err, "field "+key)
+	}
+	if i, ok := v.info.methods[key]; ok {
+		m, ok := v.methods[key]
+		if !ok {
+			m = wrapFunc(key, v.ptr.Method(i))
+			if v.methods == nil {
+				v.methods = make(map[string]Value)
+			}
+			v.methods[key] = m
+		}
+		return m, true, nil
+	}
+	return nil, false, nil
+}
+
+// set the field 'key' of the wrapped Go value, the
+// bool result is false if it has none with that name
+func (v *GoObject) setGo(key string, value Value) (bool, error) {
+	if !v.ptr.IsValid() {
+		return false, nil
+	}
+	if v.goKind() == reflect.Map {
+		m := v.ptr.Elem()
+		res := reflect.New(m.Type().Elem()).Elem()
+		d := decoder{seen: make(map[interface{}]bool)}
+		if err := d.decode(value, res); err != nil {
+			return true, inside(err, "field "+key)
+		}
+		m.SetMapIndex(reflect.ValueOf(key).Convert(m.Type().Key()), res)
+		return true, nil
+	}
+	if i, ok := v.info.byName[key]; ok {
+		f := v.ptr.Elem().FieldByIndex(v.info.fields[i].index)
+		res := reflect.New(f.Type()).Elem()
+		d := decoder{seen: make(map[interface{}]bool)}
+		if err := d.decode(value, res); err != nil {
+			return true, inside(err, "field "+key)
+		}
+		f.Set(res)
+		return true, nil
+	}
+	if _, ok := v.info.methods[key]; ok {
+		return true, fmt.Errorf("cannot assign to method %s", key)
+	}
+	return false, nil
+}
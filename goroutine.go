@@ -0,0 +1,460 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// goroutines and channels.
+//
+// The goroutines started by a script are coroutines scheduled by the
+// VM which runs it, each one with a call stack of its own. Only one
+// of them runs at a time, in the Go goroutine which called RunBytecode,
+// and it runs until it waits in a channel operation, sleeps or runs
+// for GoroutineQuantum instructions, then the scheduler chooses the next
+// one among those which can run. The choices are made by a random
+// generator seeded with VM.Seed, so a script which doesn't depend on
+// the timing of sleeps or of the host runs the same way for the same seed.
+//
+// The script finishes when its main function returns or when one of
+// its goroutines fails, the goroutines still alive are discarded.
+// When all of them wait for channels, the VM waits for the host to
+// use the channels. The channels made by the script can't be used
+// by the host until they're given to it: passed to a host function
+// other than the builtins, stored in a Go object, sent on a channel
+// of the host or returned by VM.Call. So when all the goroutines wait
+// for channels which the host can't use, and none of them sleeps,
+// the script fails with a deadlock error like a Go program does.
+
+import (
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+// a goroutine of a script, the VM's fields currentFrame and calls hold
+// the state of the one running, see VM.switchTo
+type coroutine struct {
+	calls        callFrameStack
+	currentFrame *callFrame
+	base         int          // the coroutine finishes when its stack is down to base
+	start        *pendingCall // the call which the coroutine makes when it first runs
+
+	// the channel operation the coroutine waits for, and its
+	// result when the scheduler completed it on its behalf
+	waiting []reflect.SelectCase
+	done    *chanResult
+
+	wake time.Time // the coroutine sleeps until then
+}
+
+// the result of a channel operation
+type chanResult struct {
+	chosen int // the index of the case, -1 for the default
+	value  Value
+	ok     bool
+	panic  interface{} // the panic of a send on a closed channel
+}
+
+type scheduler struct {
+	rand       *rand.Rand
+	coroutines []*coroutine // the coroutines alive, in order of creation
+	current    *coroutine
+	nested     int // runs of scripts inside host calls, they can't switch goroutines
+
+	// the channels made by the script which weren't given to the host,
+	// only the goroutines of the script can use them
+	local map[Chan]bool
+}
+
+// the instruction which waits for a channel operation runs again when
+// the goroutine is resumed, see VM.chanSelect
+const chanWaiting = -2
+
+// Seed sets the seed of the choices of the goroutine scheduler
+// in the next scripts the VM runs.
+func (vm *VM) Seed(seed int64) {
+	vm.seed = seed
+}
+
+// run the frame at index 'base' as the main goroutine, along with the
+// goroutines it starts, until it returns or one of them fails
+func (vm *VM) schedule(base int) error {
+	s := &scheduler{rand: rand.New(rand.NewSource(vm.seed)), local: make(map[Chan]bool)}
+	main := &coroutine{base: base}
+	s.coroutines = []*coroutine{main}
+	s.current = main
+	vm.sched = s
+	defer func() {
+		vm.switchTo(main)
+		vm.sched = nil
+	}()
+
+	for {
+		co, err := vm.nextCoroutine()
+		if err != nil {
+			return err
+		}
+		vm.switchTo(co)
+		vm.steps = GoroutineQuantum
+		if co.start != nil {
+			err = vm.startCoroutine(co)
+		} else {
+			err = mainLoop(vm, co.base)
+		}
+		if err != nil {
+			return err
+		}
+
+		if vm.calls.sp <= co.base {
+			if co == main {
+				return nil
+			}
+			s.remove(co)
+		}
+	}
+}
+
+// make 'co' the running goroutine
+func (vm *VM) switchTo(co *coroutine) {
+	s := vm.sched
+	if s.current == co {
+		return
+	}
+	cur := s.current
+	cur.calls, cur.currentFrame = vm.calls, vm.currentFrame
+	vm.calls, vm.currentFrame = co.calls, co.currentFrame
+	s.current = co
+}
+
+func (s *scheduler) remove(co *coroutine) {
+	for i, other := range s.coroutines {
+		if other == co {
+			s.coroutines = append(s.coroutines[:i], s.coroutines[i+1:]...)
+			return
+		}
+	}
+}
+
+// start a goroutine which makes the call 'c'
+func (vm *VM) goroutine(c pendingCall) {
+	s := vm.sched
+	s.coroutines = append(s.coroutines, &coroutine{start: &c})
+}
+
+// make the first call of the running goroutine 'co', a script
+// function runs until it yields and a host function until it returns
+func (vm *VM) startCoroutine(co *coroutine) error {
+	c := co.start
+	co.start = nil
+
+	// the results of the call are discarded in this frame
+	cf := vm.calls.New()
+	cf.fn = nil
+	co.base = vm.calls.sp
+
+	switch fn := c.fn.(type) {
+	case GoFunc:
+		if callGoFunc(vm, cf, fn, "", c.this, 0, 0, c.args, c.kwargs) == 1 {
+			return vm.error
+		}
+		vm.calls.Pop()
+		return nil
+	case *Func:
+		if callFunc(vm, cf, fn, c.this, 0, 0, c.args, c.kwargs) == 1 {
+			return vm.error
+		}
+	}
+	return mainLoop(vm, co.base)
+}
+
+// called when the quantum of the running goroutine is over or it
+// has to wait, returns true if it can give way to the others
+func (vm *VM) preempt() bool {
+	if vm.sched == nil || vm.sched.nested > 0 {
+		vm.steps = GoroutineQuantum
+		return false
+	}
+	return true
+}
+
+// choose the next goroutine to run, when none of them can run
+// it waits for the channel operations of the host and the sleeps
+func (vm *VM) nextCoroutine() (*coroutine, error) {
+	s := vm.sched
+	for {
+		for _, co := range s.coroutines {
+			if co.waiting != nil && co.done == nil {
+				if r := s.try(co.waiting); r.chosen >= 0 {
+					co.done = &r
+				}
+			}
+		}
+		s.match()
+
+		now := time.Now()
+		var ready []*coroutine
+		var sleeper *coroutine
+		for _, co := range s.coroutines {
+			switch {
+			case co.waiting != nil:
+				if co.done != nil {
+					ready = append(ready, co)
+				}
+			case co.wake.After(now):
+				if sleeper == nil || co.wake.Before(sleeper.wake) {
+					sleeper = co
+				}
+			default:
+				ready = append(ready, co)
+			}
+		}
+		if len(ready) > 0 {
+			return ready[s.rand.Intn(len(ready))], nil
+		}
+
+		// all of them wait, only the host or the time can wake them
+		var cases []reflect.SelectCase
+		var owners []*coroutine
+		for _, co := range s.coroutines {
+			for _, c := range co.waiting {
+				cases = append(cases, c)
+				owners = append(owners, co)
+			}
+		}
+		if sleeper == nil && s.unreachable(cases) {
+			// the error is reported by the main goroutine
+			vm.switchTo(s.coroutines[0])
+			return nil, vm.newRuntimeError("all goroutines are asleep - deadlock!")
+		}
+		var timer *time.Timer
+		if sleeper != nil {
+			timer = time.NewTimer(sleeper.wake.Sub(now))
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+		}
+		waitHost(cases, owners)
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// wait for one of the cases of the waiting goroutines to be completed
+// by the host, the cases after the owners are timers
+func waitHost(cases []reflect.SelectCase, owners []*coroutine) {
+	defer func() {
+		// a channel was closed while sending on it, the
+		// goroutine finds it out when its case is tried again
+		recover()
+	}()
+	chosen, recv, recvOK := reflect.Select(cases)
+	if chosen >= len(owners) {
+		return
+	}
+	// the cases of a goroutine are contiguous
+	co, first := owners[chosen], chosen
+	for first > 0 && owners[first-1] == co {
+		first--
+	}
+	co.done = &chanResult{chosen: chosen - first, value: received(recv, recvOK), ok: recvOK}
+}
+
+// complete the operations of goroutines waiting to send and to
+// receive on the same channel, the only way for them to meet on
+// an unbuffered channel
+func (s *scheduler) match() {
+	for i, a := range s.coroutines {
+		if a.waiting == nil || a.done != nil {
+			continue
+		}
+		for _, b := range s.coroutines[i+1:] {
+			if b.waiting == nil || b.done != nil {
+				continue
+			}
+			if rendezvous(a, b) || rendezvous(b, a) {
+				break
+			}
+		}
+	}
+}
+
+// complete a send of 'from' with a receive of 'to' on the same channel
+func rendezvous(from, to *coroutine) bool {
+	for i, send := range from.waiting {
+		if send.Dir != reflect.SelectSend {
+			continue
+		}
+		for j, recv := range to.waiting {
+			if recv.Dir == reflect.SelectRecv && recv.Chan.Pointer() == send.Chan.Pointer() {
+				from.done = &chanResult{chosen: i, value: Nil{}}
+				to.done = &chanResult{chosen: j, value: received(send.Send, true), ok: true}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// try the cases in random order without blocking, the chosen
+// index is -1 if none of them can proceed
+func (s *scheduler) try(cases []reflect.SelectCase) (r chanResult) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.panic = p
+		}
+	}()
+
+	r.chosen = -1
+	for _, i := range s.rand.Perm(len(cases)) {
+		r.chosen = i
+		chosen, recv, recvOK := reflect.Select([]reflect.SelectCase{cases[i], {Dir: reflect.SelectDefault}})
+		if chosen == 0 {
+			r.value, r.ok = received(recv, recvOK), recvOK
+			return r
+		}
+	}
+	r.chosen = -1
+	return r
+}
+
+// perform one of the channel operations in 'cases' like a select
+// statement, when none of them can proceed the running goroutine
+// waits for one while the others run, unless 'block' is false,
+// then -1 is chosen. When it waits the instruction of 'cf' runs
+// again once the operation is completed, and chanWaiting is chosen
+func (vm *VM) chanSelect(cf *callFrame, cases []reflect.SelectCase, block bool) (chanResult, bool) {
+	s := vm.sched
+	co := s.current
+	if co.done != nil {
+		r := *co.done
+		co.waiting, co.done = nil, nil
+		return r, vm.chanPanic(r)
+	}
+
+	for _, c := range cases {
+		if c.Dir == reflect.SelectSend && !s.local[c.Chan.Interface().(Chan)] {
+			vm.escape(c.Send.Interface().(Value))
+		}
+	}
+	r := s.try(cases)
+	if r.chosen >= 0 || !block {
+		return r, vm.chanPanic(r)
+	}
+
+	if !vm.preempt() {
+		// inside a host call, only the host can complete the operation
+		if s.unreachable(cases) {
+			vm.setError("all goroutines are asleep - deadlock!")
+			return r, false
+		}
+		r.chosen, r.value, r.ok = waitChan(cases)
+		return r, true
+	}
+	co.waiting = cases
+	vm.steps = 0
+	cf.pc--
+	r.chosen = chanWaiting
+	return r, true
+}
+
+// none of the channels of 'cases' can be used by the host, a nil
+// channel can't be used by anyone
+func (s *scheduler) unreachable(cases []reflect.SelectCase) bool {
+	for _, c := range cases {
+		if ch := c.Chan.Interface().(Chan); ch != nil && !s.local[ch] {
+			return false
+		}
+	}
+	return true
+}
+
+// the value 'v' is given to the host, which
+// can use the channels in it from now on
+func (vm *VM) escape(v Value) {
+	if s := vm.sched; s != nil && len(s.local) > 0 {
+		s.escape(v, make(map[interface{}]bool))
+	}
+}
+
+// the arguments of a call of the host function 'fn' are
+// given to the host, unless it's one of the builtins
+func (vm *VM) escapeCall(fn GoFunc, this Value, args []Value, kwargs map[string]Value) {
+	if s := vm.sched; s == nil || len(s.local) == 0 || isBuiltin(fn) {
+		return
+	}
+	vm.escape(this)
+	for _, arg := range args {
+		vm.escape(arg)
+	}
+	for _, arg := range kwargs {
+		vm.escape(arg)
+	}
+}
+
+func (s *scheduler) escape(v Value, seen map[interface{}]bool) {
+	switch v := v.(type) {
+	case Chan:
+		delete(s.local, v)
+	case *Array:
+		if seen[v] {
+			return
+		}
+		seen[v] = true
+		for _, elem := range *v {
+			s.escape(elem, seen)
+		}
+	case *Object:
+		s.escapeObject(v, seen)
+	case *GoObject:
+		s.escapeObject(&v.Object, seen)
+	}
+}
+
+func (s *scheduler) escapeObject(obj *Object, seen map[interface{}]bool) {
+	for obj != nil && !seen[obj] {
+		seen[obj] = true
+		for _, field := range obj.Fields {
+			s.escape(field, seen)
+		}
+		obj = obj.Parent
+	}
+}
+
+func waitChan(cases []reflect.SelectCase) (int, Value, bool) {
+	chosen, recv, recvOK := reflect.Select(cases)
+	return chosen, received(recv, recvOK), recvOK
+}
+
+// report the panic of a channel operation as a runtime error
+func (vm *VM) chanPanic(r chanResult) bool {
+	if r.panic != nil {
+		vm.setError("%v", r.panic)
+		return false
+	}
+	return true
+}
+
+// make the running goroutine sleep for 'd', the others run meanwhile
+func (vm *VM) sleep(d time.Duration) {
+	if !vm.preempt() {
+		time.Sleep(d)
+		return
+	}
+	vm.sched.current.wake = time.Now().Add(d)
+	vm.steps = 0
+}
+
+func received(recv reflect.Value, recvOK bool) Value {
+	if recvOK {
+		// the host may send nil interfaces
+		if v, _ := recv.Interface().(Value); v != nil {
+			return v
+		}
+	}
+	return Nil{}
+}
+
+func sendCase(ch Chan, v Value) reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch), Send: reflect.ValueOf(&v).Elem()}
+}
+
+func recvCase(ch Chan) reflect.SelectCase {
+	return reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+}
@@ -23,35 +23,38 @@ const (
 	OpLoadnil    Opcode = iota //  R(A) ... R(B) = nil
 	OpLoadconst                //  R(A) = K(Bx)
 	OpLoadglobal               //  R(A) = globals[K(Bx)]
-	OpSetglobal                //  TODO: remove this opcode
-	OpLoadFree                 //  R(A) = refs[K(Bx)]
-	OpSetFree                  //  refs[K(Bx)] = R(A)
+	OpSetglobal                //  globals[K(Bx)] = R(A)
+	OpLoadFree                 //  R(A) = upvalues[Bx]
+	OpSetFree                  //  upvalues[Bx] = R(A)
 
 	OpUnm  //  R(A) = -RK(Bx)
 	OpNot  //  R(A) = NOT RK(Bx)
 	OpCmpl //  R(A) = ^RK(B)
 
-	OpAdd //  R(A) = RK(B) + RK(C)
-	OpSub //  R(A) = RK(B) - RK(C)
-	OpMul //  R(A) = RK(B) * RK(C)
-	OpDiv //  R(A) = RK(B) / RK(C)
-	OpPow //  R(A) = pow(RK(B), RK(C))
-	OpShl //  R(A) = RK(B) << RK(C)
-	OpShr //  R(A) = RK(B) >> RK(C)
-	OpAnd //  R(A) = RK(B) & RK(C)
-	OpOr  //  R(A) = RK(B) | RK(C)
-	OpXor //  R(A) = RK(B) ^ RK(C)
-	OpLt  //  R(A) = RK(B) < RK(C)
-	OpLe  //  R(A) = RK(B) <= RK(C)
-	OpEq  //  R(A) = RK(B) == RK(C)
-	OpNe  //  R(A) = RK(B) != RK(C)
+	OpAdd    //  R(A) = RK(B) + RK(C)
+	OpSub    //  R(A) = RK(B) - RK(C)
+	OpMul    //  R(A) = RK(B) * RK(C)
+	OpDiv    //  R(A) = RK(B) / RK(C)
+	OpPow    //  R(A) = pow(RK(B), RK(C))
+	OpMod    //  R(A) = RK(B) % RK(C)
+	OpIntdiv //  R(A) = trunc(RK(B) / RK(C))
+	OpShl    //  R(A) = RK(B) << RK(C)
+	OpShr    //  R(A) = RK(B) >> RK(C)
+	OpAnd    //  R(A) = RK(B) & RK(C)
+	OpOr     //  R(A) = RK(B) | RK(C)
+	OpXor    //  R(A) = RK(B) ^ RK(C)
+	OpLt     //  R(A) = RK(B) < RK(C)
+	OpLe     //  R(A) = RK(B) <= RK(C)
+	OpEq     //  R(A) = RK(B) == RK(C)
+	OpNe     //  R(A) = RK(B) != RK(C)
 
 	OpMove     //  R(A) = R(B)
 	OpGetIndex //  R(A) = R(B)[RK(C)]
 	OpSetIndex //  R(A)[RK(B)] = RK(C)
 	OpAppend   //  R(A) = append(R(A), R(A+1) ... R(A+B))
+	OpSlice    //  R(A) = R(B)[R(C):R(C+1)], nil bounds are the defaults
 
-	OpCall       //  R(A) ... R(A+B-1) = R(A)(R(A+B) ... R(A+B+C-1))
+	OpCall       //  R(A) ... R(A+B-1) = R(A)(R(A+B) ... R(A+B+C-1)), see OpCallArgsMask
 	OpCallmethod //  same as OpCall, but first argument is the receiver
 	OpArray      //  R(A) = []
 	OpObject     //  R(A) = {}
@@ -60,14 +63,27 @@ const (
 	OpJmp      //  pc = pc + sBx
 	OpJmptrue  //  pc = pc + sBx if RK(A) is not false or nil
 	OpJmpfalse //  pc = pc + sBx if RK(A) is false or nil
+	OpSwitch   //  pc = pc + jumptables[Bx][R(A)] if R(A) is in the table
 	OpReturn   //  return R(A) ... R(A+B-1)
-	OpForbegin //  R(A), R(A+1) = objkeys(R(B)), len(objkeys(R(B))) if R(B) is an object
-	//  R(A), R(A+1) = R(B), len(R(B)) if R(B) is an array
-	//  error if not array
-
-	OpForiter //  R(A) = R(A+1)++ if R(B) is an array
-	//  R(A) = R(C)[R(A+1)++] if R(B) is an object (R(C) should be an array of keys of the object)
-	kOpCount int = int(OpForiter) + 1
+	OpForbegin //  R(A) = iteration state of R(B), R(A+1) = 0
+	OpForiter  //  R(C), R(C+1) = next key and value of R(B), pc++
+	//  unless the iteration is over (see OpForiter in vm.go)
+
+	OpTrybegin //  push handler, on panic: R(A) = value, pc = pc + sBx
+	OpTryend   //  pop handler
+	OpPanic    //  panic R(A), if B == 1 rethrow the panic caught in R(A)
+	OpDefer    //  defer R(A)(R(A+1) ... R(A+C)), R(A+1) is the receiver if B == 1
+	OpRecover  //  R(A) = recover()
+
+	OpGo       //  go R(A)(R(A+1) ... R(A+C)), R(A+1) is the receiver if B == 1
+	OpMakechan //  R(A) = make(chan, RK(B))
+	OpSend     //  R(A) <- RK(B)
+	OpRecv     //  R(A) = <-R(B), if C == 1 R(A+1) = ok
+	OpSelect   //  R(A), R(A+1), R(A+2) = select on the cases in R(A+3) ..., see OpSelect in vm.go
+	OpYield    //  suspend the generator giving R(A) to the caller
+	OpClose    //  close the upvalues of the registers from R(A) upwards
+
+	kOpCount int = int(OpClose) + 1
 )
 
 // instruction parameters
@@ -89,6 +105,14 @@ const (
 // offset for RK
 const OpConstOffset = 250
 
+// the C argument of OpCall and OpCallmethod is the number
+// of arguments combined with these flags
+const (
+	OpCallArgsMask = 0x7f
+	OpCallSpread   = 0x80  // the last positional argument is an array to spread
+	OpCallKwargs   = 0x100 // the last argument is an object with the keyword arguments
+)
+
 var (
 	opStrings = map[Opcode]string{
 		OpLoadnil:    "loadnil",
@@ -102,25 +126,28 @@ var (
 		OpNot:  "not",
 		OpCmpl: "cmpl",
 
-		OpAdd: "add",
-		OpSub: "sub",
-		OpMul: "mul",
-		OpDiv: "div",
-		OpPow: "pow",
-		OpShl: "shl",
-		OpShr: "shr",
-		OpAnd: "and",
-		OpOr:  "or",
-		OpXor: "xor",
-		OpLt:  "lt",
-		OpLe:  "le",
-		OpEq:  "eq",
-		OpNe:  "ne",
+		OpAdd:    "add",
+		OpSub:    "sub",
+		OpMul:    "mul",
+		OpDiv:    "div",
+		OpPow:    "pow",
+		OpMod:    "mod",
+		OpIntdiv: "intdiv",
+		OpShl:    "shl",
+		OpShr:    "shr",
+		OpAnd:    "and",
+		OpOr:     "or",
+		OpXor:    "xor",
+		OpLt:     "lt",
+		OpLe:     "le",
+		OpEq:     "eq",
+		OpNe:     "ne",
 
 		OpMove:     "move",
 		OpGetIndex: "getindex",
 		OpSetIndex: "setindex",
 		OpAppend:   "append",
+		OpSlice:    "slice",
 
 		OpCall:       "call",
 		OpCallmethod: "callmethod",
@@ -131,9 +158,24 @@ var (
 		OpJmp:      "jmp",
 		OpJmptrue:  "jmptrue",
 		OpJmpfalse: "jmpfalse",
+		OpSwitch:   "switch",
 		OpReturn:   "return",
 		OpForbegin: "forbegin",
 		OpForiter:  "foriter",
+
+		OpTrybegin: "trybegin",
+		OpTryend:   "tryend",
+		OpPanic:    "panic",
+		OpDefer:    "defer",
+		OpRecover:  "recover",
+
+		OpGo:       "go",
+		OpMakechan: "makechan",
+		OpSend:     "send",
+		OpRecv:     "recv",
+		OpSelect:   "select",
+		OpYield:    "yield",
+		OpClose:    "close",
 	}
 )
 
@@ -22,6 +22,14 @@ type ParseError struct {
 	Message string
 }
 
+// names of the types returned by the builtin 'type',
+// they can be used as bare identifiers in a type switch
+var typeNames = map[string]bool{
+	"nil": true, "bool": true, "number": true, "string": true,
+	"func": true, "array": true, "object": true, "chan": true,
+	"generator": true,
+}
+
 func (err *ParseError) Error() string {
 	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Message)
 }
@@ -48,15 +56,16 @@ func parseNumber(typ ast.Token, str string) float64 {
 
 func (p *parser) error(msg string) {
 	t := p.tokenizer
-	panic(&ParseError{Guilty: p.tok, Line: t.lineno, File: t.filename, Message: msg})
+	panic(&ParseError{Guilty: p.tok, Line: t.tokLine, File: t.filename, Message: msg})
 }
 
 func (p *parser) errorExpected(expected string) {
 	p.error(fmt.Sprintf("unexpected %s, expected %s", p.tok, expected))
 }
 
+// the line of the current token, the tokenizer is already past it
 func (p *parser) line() int {
-	return p.tokenizer.lineno
+	return p.tokenizer.tokLine
 }
 
 func (p *parser) next() {
@@ -65,6 +74,9 @@ func (p *parser) next() {
 	for p.ignoreNewlines && p.tok == ast.TokenNewline {
 		p.tok, p.literal = p.tokenizer.nextToken()
 	}
+	if p.tok == ast.TokenIllegal {
+		p.error(fmt.Sprintf("unexpected %s", p.literal))
+	}
 }
 
 func (p *parser) accept(toktype ast.Token) bool {
@@ -148,6 +160,18 @@ func (p *parser) exprList(inArray bool) []ast.Node {
 	return list
 }
 
+// list of values of an assignment, the last one may be
+// an array to unpack, e.g.: 'x, y := arr...'
+func (p *parser) valueList() []ast.Node {
+	line := p.line()
+	list := p.exprList(false)
+	if p.accept(ast.TokenDotdotdot) {
+		last := len(list) - 1
+		list[last] = &ast.VarArg{Arg: list[last], NodeInfo: ast.NodeInfo{line}}
+	}
+	return list
+}
+
 //
 // grammar rules
 //
@@ -194,6 +218,8 @@ func (p *parser) objectFieldList() []*ast.ObjectField {
 		}
 
 		if !p.accept(ast.TokenComma) {
+			// a newline after the last field without a trailing comma
+			p.accept(ast.TokenSemicolon)
 			break
 		}
 	}
@@ -343,6 +369,9 @@ func (p *parser) primaryExpr() ast.Node {
 			return &ast.Number{Value: parseNumber(p.tok, p.literal), NodeInfo: ast.NodeInfo{line}}
 		case ast.TokenId:
 			return &ast.Id{Value: p.literal, NodeInfo: ast.NodeInfo{line}}
+		case ast.TokenRecover:
+			// recover() inside a deferred function, see VisitCallExpr
+			return &ast.Id{Value: "recover", NodeInfo: ast.NodeInfo{line}}
 		case ast.TokenString:
 			return &ast.String{Value: p.literal, NodeInfo: ast.NodeInfo{line}}
 		case ast.TokenTrue, ast.TokenFalse:
@@ -367,11 +396,20 @@ func (p *parser) selectorExpr(left ast.Node) ast.Node {
 
 func (p *parser) subscriptExpr(left ast.Node) ast.Node {
 	line := p.line()
-	expr := p.expr()
+	var expr ast.Node
+	if p.tok != ast.TokenColon {
+		expr = p.expr()
+	}
 	sub := &ast.Subscript{Left: left, Right: expr}
 	if p.accept(ast.TokenColon) {
-		expr2 := p.expr()
+		// both bounds of a slice are optional
+		var expr2 ast.Node
+		if p.tok != ast.TokenRbrack {
+			expr2 = p.expr()
+		}
 		sub.Right = &ast.Slice{Start: expr, End: expr2, NodeInfo: ast.NodeInfo{line}}
+	} else if expr == nil {
+		p.errorExpected("expression")
 	}
 
 	if !p.accept(ast.TokenRbrack) {
@@ -456,9 +494,12 @@ func (p *parser) callExpr() ast.Node {
 			p.errorExpected("closing ')'")
 		}
 		left = &ast.CallExpr{Left: left, Args: args, NodeInfo: ast.NodeInfo{line}}
+
+		// allow chaining, e.g.: a.b().c()
+		left = p.selectorOrSubscriptExpr(left)
 	}
 
-	return p.selectorOrSubscriptExpr(left)
+	return left
 }
 
 func (p *parser) postfixExpr() ast.Node {
@@ -556,7 +597,7 @@ func (p *parser) declaration() ast.Node {
 		return &ast.Declaration{IsConst: isConst, Left: left, NodeInfo: ast.NodeInfo{line}}
 	}
 
-	right := p.exprList(false)
+	right := p.valueList()
 	return &ast.Declaration{IsConst: isConst, Left: left, Right: right, NodeInfo: ast.NodeInfo{line}}
 }
 
@@ -567,6 +608,16 @@ func (p *parser) assignment(left []ast.Node) ast.Node {
 		left = p.exprList(false)
 	}
 
+	if p.tok == ast.TokenLarrow {
+		// a send statement
+		if len(left) > 1 {
+			p.error("illegal expression")
+		}
+		p.next()
+		value := p.expr()
+		return &ast.SendStmt{Chan: left[0], Value: value, NodeInfo: ast.NodeInfo{line}}
+	}
+
 	if !ast.IsAssignOp(p.tok) {
 		if len(left) > 1 {
 			p.error("illegal expression")
@@ -590,7 +641,7 @@ func (p *parser) assignment(left []ast.Node) ast.Node {
 	op := p.tok
 	p.next()
 
-	right := p.exprList(false)
+	right := p.valueList()
 	return &ast.Assignment{Op: op, Left: left, Right: right, NodeInfo: ast.NodeInfo{line}}
 }
 
@@ -605,16 +656,40 @@ func (p *parser) stmt() ast.Node {
 		return &ast.BranchStmt{Type: tok, NodeInfo: ast.NodeInfo{line}}
 	case ast.TokenReturn:
 		p.next()
-		values := p.exprList(false)
+		var values []ast.Node
+		switch p.tok {
+		case ast.TokenRbrace, ast.TokenSemicolon, ast.TokenCase, ast.TokenDefault, ast.TokenEos:
+			// a return without values
+		default:
+			values = p.exprList(false)
+		}
 		return &ast.ReturnStmt{Values: values, NodeInfo: ast.NodeInfo{line}}
 	case ast.TokenPanic:
 		p.next()
 		err := p.expr()
 		return &ast.PanicStmt{Err: err, NodeInfo: ast.NodeInfo{line}}
+	case ast.TokenYield:
+		p.next()
+		value := p.expr()
+		return &ast.YieldStmt{Value: value, NodeInfo: ast.NodeInfo{line}}
+	case ast.TokenDefer, ast.TokenGo:
+		p.next()
+		call, ok := p.expr().(*ast.CallExpr)
+		if !ok {
+			p.error(fmt.Sprintf("expression in %s must be a function call", tok))
+		}
+		if tok == ast.TokenGo {
+			return &ast.GoStmt{Call: call, NodeInfo: ast.NodeInfo{line}}
+		}
+		return &ast.DeferStmt{Call: call, NodeInfo: ast.NodeInfo{line}}
 	case ast.TokenIf:
 		return p.ifStmt()
 	case ast.TokenFor:
 		return p.forStmt()
+	case ast.TokenSwitch:
+		return p.switchStmt()
+	case ast.TokenSelect:
+		return p.selectStmt()
 	case ast.TokenTry:
 		return p.tryRecoverStmt()
 	default:
@@ -731,6 +806,172 @@ parseBody:
 	return &ast.ForStmt{Init: init, Cond: cond, Step: step, Body: body, NodeInfo: ast.NodeInfo{line}}
 }
 
+// a switch over type(x), which allows the type names in the cases
+func isTypeSwitch(tag ast.Node) bool {
+	call, ok := tag.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return false
+	}
+	id, ok := call.Left.(*ast.Id)
+	return ok && id.Value == "type"
+}
+
+func (p *parser) caseValues(typeSwitch bool) []ast.Node {
+	var list []ast.Node
+	for {
+		line := p.line()
+		var value ast.Node
+		if typeSwitch && (p.tok == ast.TokenNil || p.tok == ast.TokenFunc) {
+			// 'nil' and 'func' are keywords
+			value = &ast.String{Value: p.tok.String(), NodeInfo: ast.NodeInfo{line}}
+			p.next()
+		} else {
+			value = p.expr()
+			if id, ok := value.(*ast.Id); ok && typeSwitch && typeNames[id.Value] {
+				value = &ast.String{Value: id.Value, NodeInfo: ast.NodeInfo{line}}
+			}
+		}
+		list = append(list, value)
+
+		if !p.accept(ast.TokenComma) {
+			break
+		}
+	}
+	return list
+}
+
+func (p *parser) caseClause(typeSwitch bool) *ast.CaseClause {
+	line := p.line()
+
+	var values []ast.Node
+	if !p.accept(ast.TokenDefault) {
+		p.next() // 'case'
+		values = p.caseValues(typeSwitch)
+	}
+	if !p.accept(ast.TokenColon) {
+		p.errorExpected("':'")
+	}
+
+	var nodes []ast.Node
+	for !(p.tok == ast.TokenCase || p.tok == ast.TokenDefault || p.tok == ast.TokenRbrace || p.tok == ast.TokenEos) {
+		stmt := p.stmt()
+		nodes = append(nodes, stmt)
+	}
+
+	body := &ast.Block{Nodes: nodes, NodeInfo: ast.NodeInfo{line}}
+	return &ast.CaseClause{Values: values, Body: body, NodeInfo: ast.NodeInfo{line}}
+}
+
+func (p *parser) switchStmt() ast.Node {
+	line := p.line()
+	p.next() // 'switch'
+
+	var init *ast.Assignment
+	var tag ast.Node
+	if p.tok != ast.TokenLbrace {
+		var ok bool
+		tag = p.assignment(nil)
+		init, ok = tag.(*ast.Assignment)
+		if ok {
+			if !p.accept(ast.TokenSemicolon) {
+				p.errorExpected("';'")
+			}
+			tag = nil
+			if p.tok != ast.TokenLbrace {
+				tag = p.expr()
+			}
+		}
+	}
+
+	if !p.accept(ast.TokenLbrace) {
+		p.errorExpected("'{'")
+	}
+
+	var cases []*ast.CaseClause
+	var hasDefault bool
+	typeSwitch := isTypeSwitch(tag)
+	for p.tok == ast.TokenCase || p.tok == ast.TokenDefault {
+		if p.tok == ast.TokenDefault {
+			if hasDefault {
+				p.error("multiple defaults in switch")
+			}
+			hasDefault = true
+		}
+		cases = append(cases, p.caseClause(typeSwitch))
+	}
+
+	if !p.accept(ast.TokenRbrace) {
+		p.errorExpected("'case', 'default' or closing '}'")
+	}
+	return &ast.SwitchStmt{Init: init, Tag: tag, Cases: cases, NodeInfo: ast.NodeInfo{line}}
+}
+
+// check if the node is a receive operation, <-ch
+func isReceive(node ast.Node) bool {
+	unary, ok := node.(*ast.UnaryExpr)
+	return ok && unary.Op == ast.TokenLarrow
+}
+
+func (p *parser) commClause() *ast.CommClause {
+	line := p.line()
+
+	var comm ast.Node
+	if !p.accept(ast.TokenDefault) {
+		p.next() // 'case'
+		comm = p.assignment(nil)
+		switch c := comm.(type) {
+		case *ast.SendStmt:
+		case *ast.Assignment:
+			if c.Op != ast.TokenEq && c.Op != ast.TokenColoneq || len(c.Left) > 2 ||
+				len(c.Right) != 1 || !isReceive(c.Right[0]) {
+				p.error("select case must be a receive, send or assignment of a receive")
+			}
+		default:
+			if !isReceive(comm) {
+				p.error("select case must be a receive, send or assignment of a receive")
+			}
+		}
+	}
+	if !p.accept(ast.TokenColon) {
+		p.errorExpected("':'")
+	}
+
+	var nodes []ast.Node
+	for !(p.tok == ast.TokenCase || p.tok == ast.TokenDefault || p.tok == ast.TokenRbrace || p.tok == ast.TokenEos) {
+		stmt := p.stmt()
+		nodes = append(nodes, stmt)
+	}
+
+	body := &ast.Block{Nodes: nodes, NodeInfo: ast.NodeInfo{line}}
+	return &ast.CommClause{Comm: comm, Body: body, NodeInfo: ast.NodeInfo{line}}
+}
+
+func (p *parser) selectStmt() ast.Node {
+	line := p.line()
+	p.next() // 'select'
+
+	if !p.accept(ast.TokenLbrace) {
+		p.errorExpected("'{'")
+	}
+
+	var cases []*ast.CommClause
+	var hasDefault bool
+	for p.tok == ast.TokenCase || p.tok == ast.TokenDefault {
+		if p.tok == ast.TokenDefault {
+			if hasDefault {
+				p.error("multiple defaults in select")
+			}
+			hasDefault = true
+		}
+		cases = append(cases, p.commClause())
+	}
+
+	if !p.accept(ast.TokenRbrace) {
+		p.errorExpected("'case', 'default' or closing '}'")
+	}
+	return &ast.SelectStmt{Cases: cases, NodeInfo: ast.NodeInfo{line}}
+}
+
 func (p *parser) tryRecoverStmt() ast.Node {
 	line := p.line()
 	p.next() // 'try'
@@ -756,6 +997,10 @@ func (p *parser) tryRecoverStmt() ast.Node {
 		finallyBlock = p.block().(*ast.Block)
 	}
 
+	if recoverBlock == nil && finallyBlock == nil {
+		p.errorExpected("'recover' or 'finally'")
+	}
+
 	return &ast.TryRecoverStmt{
 		Try:      tryBlock,
 		Recover:  recoverBlock,
@@ -7,7 +7,10 @@ package parse
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
+
+	"github.com/glhrmfrts/yo/ast"
 )
 
 func TestExpr(t *testing.T) {
@@ -102,3 +105,26 @@ func TestFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenizer(t *testing.T) {
+	var tz tokenizer
+	tz.init([]byte("a ~/ b ~/= c <<= d >>= e %= f ~ g"), "<test>")
+	expected := []ast.Token{
+		ast.TokenId, ast.TokenIntdiv, ast.TokenId, ast.TokenIntdiveq,
+		ast.TokenId, ast.TokenLtlteq, ast.TokenId, ast.TokenGtgteq,
+		ast.TokenId, ast.TokenModeq, ast.TokenId, ast.TokenIllegal,
+		ast.TokenId, ast.TokenEos,
+	}
+	for i, tok := range expected {
+		if res, lit := tz.nextToken(); res != tok {
+			t.Errorf("(%d) expected %s, got %s %q", i, tok, res, lit)
+		}
+	}
+
+	for _, expr := range []string{"a ~ b", "a ~"} {
+		_, err := ParseExpr([]byte(expr))
+		if err == nil || !strings.Contains(err.Error(), "unexpected ~") {
+			t.Errorf("%s: expected an error, got %v", expr, err)
+		}
+	}
+}
@@ -51,6 +51,7 @@ type tokenizer struct {
 	src        []byte
 	filename   string
 	lineno     int
+	tokLine    int // the line where the last token scanned starts
 	insertSemi bool
 	last       ast.Token
 }
@@ -320,7 +321,10 @@ func (t *tokenizer) skipWhitespace() {
 
 func (t *tokenizer) needSemi(tok ast.Token) bool {
 	return (tok == ast.TokenId || tok == ast.TokenFloat || tok == ast.TokenInt || tok == ast.TokenString ||
-		tok == ast.TokenBreak || tok == ast.TokenContinue || tok == ast.TokenReturn || tok == ast.TokenPanic)
+		tok == ast.TokenNil || tok == ast.TokenTrue || tok == ast.TokenFalse ||
+		tok == ast.TokenBreak || tok == ast.TokenContinue || tok == ast.TokenReturn || tok == ast.TokenPanic ||
+		tok == ast.TokenFallthrough || tok == ast.TokenRparen || tok == ast.TokenRbrack || tok == ast.TokenRbrace ||
+		tok == ast.TokenPlusplus || tok == ast.TokenMinusminus)
 }
 
 // functions that look 1 or 2 characters ahead,
@@ -376,6 +380,12 @@ func (t *tokenizer) maybe3(a ast.Token, c1 rune, t1 ast.Token, c2 rune, t2 ast.T
 func (t *tokenizer) scan() (ast.Token, string) {
 	t.skipWhitespace()
 
+	// lineno already counts the newline in t.r
+	t.tokLine = t.lineno
+	if t.r == '\n' {
+		t.tokLine--
+	}
+
 	switch ch := t.r; {
 	case isLetter(t.r):
 		lit := t.scanIdentifier()
@@ -416,7 +426,12 @@ func (t *tokenizer) scan() (ast.Token, string) {
 		case '*':
 			tok = t.maybe2(ast.TokenTimes, '=', ast.TokenTimeseq, '*', ast.TokenTimestimes)
 		case '%':
-			tok = ast.TokenMod
+			tok = t.maybe1(ast.TokenMod, '=', ast.TokenModeq)
+		case '~':
+			tok = t.maybe1(ast.TokenIllegal, '/', ast.TokenIntdiv)
+			if tok == ast.TokenIntdiv {
+				tok = t.maybe1(tok, '=', ast.TokenIntdiveq)
+			}
 		case '&':
 			tok = t.maybe2(ast.TokenAmp, '=', ast.TokenAmpeq, '&', ast.TokenAmpamp)
 		case '|':
@@ -424,9 +439,15 @@ func (t *tokenizer) scan() (ast.Token, string) {
 		case '^':
 			tok = t.maybe1(ast.TokenTilde, '=', ast.TokenTildeeq)
 		case '<':
-			tok = t.maybe2(ast.TokenLt, '=', ast.TokenLteq, '<', ast.TokenLtlt)
+			tok = t.maybe3(ast.TokenLt, '=', ast.TokenLteq, '<', ast.TokenLtlt, '-', ast.TokenLarrow)
+			if tok == ast.TokenLtlt {
+				tok = t.maybe1(tok, '=', ast.TokenLtlteq)
+			}
 		case '>':
 			tok = t.maybe2(ast.TokenGt, '=', ast.TokenGteq, '>', ast.TokenGtgt)
+			if tok == ast.TokenGtgt {
+				tok = t.maybe1(tok, '=', ast.TokenGtgteq)
+			}
 		case '=':
 			tok = t.maybe1(ast.TokenEq, '=', ast.TokenEqeq)
 		case ':':
@@ -476,8 +497,7 @@ func (t *tokenizer) scan() (ast.Token, string) {
 		return ast.TokenEos, "end"
 	}
 
-	fmt.Print(string(t.r))
-	return ast.TokenIllegal, ""
+	return ast.TokenIllegal, string(t.r)
 }
 
 func (t *tokenizer) nextToken() (ast.Token, string) {
@@ -155,12 +155,20 @@ func (p *prettyprinter) VisitSlice(node *ast.Slice, data interface{}) {
 	p.indent++
 	p.doIndent()
 
-	node.Start.Accept(p, nil)
+	if node.Start != nil {
+		node.Start.Accept(p, nil)
+	} else {
+		p.buf.WriteString("nil")
+	}
 
 	p.buf.WriteString("\n")
 	p.doIndent()
 
-	node.End.Accept(p, nil)
+	if node.End != nil {
+		node.End.Accept(p, nil)
+	} else {
+		p.buf.WriteString("nil")
+	}
 
 	p.indent--
 	p.buf.WriteString(")")
@@ -350,6 +358,45 @@ func (p *prettyprinter) VisitPanicStmt(node *ast.PanicStmt, data interface{}) {
 	p.buf.WriteString(")")
 }
 
+func (p *prettyprinter) VisitDeferStmt(node *ast.DeferStmt, data interface{}) {
+	p.buf.WriteString("(defer\n")
+	p.indent++
+	p.doIndent()
+	node.Call.Accept(p, nil)
+	p.indent--
+	p.buf.WriteString(")")
+}
+
+func (p *prettyprinter) VisitYieldStmt(node *ast.YieldStmt, data interface{}) {
+	p.buf.WriteString("(yield\n")
+	p.indent++
+	p.doIndent()
+	node.Value.Accept(p, nil)
+	p.indent--
+	p.buf.WriteString(")")
+}
+
+func (p *prettyprinter) VisitGoStmt(node *ast.GoStmt, data interface{}) {
+	p.buf.WriteString("(go\n")
+	p.indent++
+	p.doIndent()
+	node.Call.Accept(p, nil)
+	p.indent--
+	p.buf.WriteString(")")
+}
+
+func (p *prettyprinter) VisitSendStmt(node *ast.SendStmt, data interface{}) {
+	p.buf.WriteString("(<-\n")
+	p.indent++
+	p.doIndent()
+	node.Chan.Accept(p, nil)
+	p.buf.WriteString("\n")
+	p.doIndent()
+	node.Value.Accept(p, nil)
+	p.indent--
+	p.buf.WriteString(")")
+}
+
 func (p *prettyprinter) VisitIfStmt(node *ast.IfStmt, data interface{}) {
 	p.buf.WriteString("(if\n")
 	p.indent++
@@ -442,6 +489,88 @@ func (p *prettyprinter) VisitForStmt(node *ast.ForStmt, data interface{}) {
 	p.buf.WriteString(")")
 }
 
+func (p *prettyprinter) VisitCaseClause(node *ast.CaseClause, data interface{}) {
+	if node.Values == nil {
+		p.buf.WriteString("(default")
+	} else {
+		p.buf.WriteString("(case")
+	}
+	p.indent++
+
+	for _, v := range node.Values {
+		p.buf.WriteString("\n")
+		p.doIndent()
+		v.Accept(p, nil)
+	}
+
+	p.buf.WriteString("\n")
+	p.doIndent()
+	node.Body.Accept(p, nil)
+	p.indent--
+	p.buf.WriteString(")")
+}
+
+func (p *prettyprinter) VisitSwitchStmt(node *ast.SwitchStmt, data interface{}) {
+	p.buf.WriteString("(switch")
+	p.indent++
+
+	if node.Init != nil {
+		p.buf.WriteString("\n")
+		p.doIndent()
+		p.buf.WriteString("init: ")
+		node.Init.Accept(p, nil)
+	}
+
+	if node.Tag != nil {
+		p.buf.WriteString("\n")
+		p.doIndent()
+		p.buf.WriteString("tag: ")
+		node.Tag.Accept(p, nil)
+	}
+
+	for _, clause := range node.Cases {
+		p.buf.WriteString("\n")
+		p.doIndent()
+		clause.Accept(p, nil)
+	}
+
+	p.indent--
+	p.buf.WriteString(")")
+}
+
+func (p *prettyprinter) VisitCommClause(node *ast.CommClause, data interface{}) {
+	if node.Comm == nil {
+		p.buf.WriteString("(default")
+	} else {
+		p.buf.WriteString("(case\n")
+		p.indent++
+		p.doIndent()
+		node.Comm.Accept(p, nil)
+		p.indent--
+	}
+	p.indent++
+
+	p.buf.WriteString("\n")
+	p.doIndent()
+	node.Body.Accept(p, nil)
+	p.indent--
+	p.buf.WriteString(")")
+}
+
+func (p *prettyprinter) VisitSelectStmt(node *ast.SelectStmt, data interface{}) {
+	p.buf.WriteString("(select")
+	p.indent++
+
+	for _, clause := range node.Cases {
+		p.buf.WriteString("\n")
+		p.doIndent()
+		clause.Accept(p, nil)
+	}
+
+	p.indent--
+	p.buf.WriteString(")")
+}
+
 func (p *prettyprinter) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
 	p.buf.WriteString(fmt.Sprintf("(recover %s ", node.Id.Value))
 	node.Block.Accept(p, nil)
@@ -9,6 +9,8 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/glhrmfrts/yo"
+	"sort"
+	"strings"
 )
 
 func doIndent(buf *bytes.Buffer, indent int) {
@@ -30,6 +32,18 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 	}
 	buf.WriteString("\n\n")
 
+	doIndent(buf, indent)
+	buf.WriteString(fmt.Sprintf("upvalues: %d\n", f.NumUpvalues))
+	for i, uv := range f.Upvalues {
+		doIndent(buf, indent)
+		if uv.Instack {
+			buf.WriteString(fmt.Sprintf("\t%d\t%s\tlocal !%d\n", i, uv.Name, uv.Index))
+		} else {
+			buf.WriteString(fmt.Sprintf("\t%d\t%s\tupvalue %d\n", i, uv.Name, uv.Index))
+		}
+	}
+	buf.WriteString("\n")
+
 	doIndent(buf, indent)
 	buf.WriteString(fmt.Sprintf("funcs: %d\n", f.NumFuncs))
 	for _, f := range f.Funcs {
@@ -78,7 +92,7 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 			bx := yo.OpGetBx(instr)
 			bstr := getRegOrConst(bx)
 			buf.WriteString(fmt.Sprintf("\t!%d %s", yo.OpGetA(instr), bstr))
-		case yo.OpAdd, yo.OpSub, yo.OpMul, yo.OpDiv, yo.OpPow, yo.OpShl, yo.OpShr,
+		case yo.OpAdd, yo.OpSub, yo.OpMul, yo.OpDiv, yo.OpPow, yo.OpMod, yo.OpIntdiv, yo.OpShl, yo.OpShr,
 			yo.OpAnd, yo.OpOr, yo.OpXor, yo.OpLe, yo.OpLt, yo.OpEq, yo.OpNe,
 			yo.OpGetIndex, yo.OpSetIndex:
 			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
@@ -87,6 +101,9 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 		case yo.OpAppend, yo.OpReturn:
 			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
 			buf.WriteString(fmt.Sprintf("\t!%d #%d", a, b))
+		case yo.OpSlice:
+			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d !%d !%d", a, b, c))
 		case yo.OpMove:
 			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
 			buf.WriteString(fmt.Sprintf("\t!%d !%d", a, b))
@@ -95,13 +112,20 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 			buf.WriteString(fmt.Sprintf("!%d %s", a, f.Consts[bx]))
 		case yo.OpLoadFree, yo.OpSetFree:
 			a, bx := yo.OpGetA(instr), yo.OpGetBx(instr)
-			buf.WriteString(fmt.Sprintf("\t!%d %s", a, f.Consts[bx]))
+			buf.WriteString(fmt.Sprintf("\t!%d ^%d(%s)", a, bx, f.Upvalues[bx].Name))
 		case yo.OpCall, yo.OpCallmethod:
 			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			args := fmt.Sprintf("#%d", c&yo.OpCallArgsMask)
+			if c&yo.OpCallSpread != 0 {
+				args += "..."
+			}
+			if c&yo.OpCallKwargs != 0 {
+				args += " kw"
+			}
 			if opcode == yo.OpCall {
-				buf.WriteString(fmt.Sprintf("\t!%d #%d #%d", a, b, c))
+				buf.WriteString(fmt.Sprintf("\t!%d #%d %s", a, b, args))
 			} else {
-				buf.WriteString(fmt.Sprintf("!%d #%d #%d", a, b, c))
+				buf.WriteString(fmt.Sprintf("!%d #%d %s", a, b, args))
 			}
 		case yo.OpArray, yo.OpObject:
 			buf.WriteString(fmt.Sprintf("\t!%d", yo.OpGetA(instr)))
@@ -114,12 +138,50 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 			a, sbx := yo.OpGetA(instr), yo.OpGetsBx(instr)
 			astr := getRegOrConst(a)
 			buf.WriteString(fmt.Sprintf("%s ->%d", astr, pc+sbx))
+		case yo.OpSwitch:
+			a, bx := yo.OpGetA(instr), yo.OpGetBx(instr)
+			var cases []string
+			for v, offset := range f.JumpTables[bx] {
+				cases = append(cases, fmt.Sprintf("%v->%d", v, pc+offset))
+			}
+			sort.Strings(cases)
+			buf.WriteString(fmt.Sprintf("\t!%d %s", a, strings.Join(cases, " ")))
 		case yo.OpForbegin:
 			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
 			buf.WriteString(fmt.Sprintf("!%d !%d", a, b))
 		case yo.OpForiter:
 			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
 			buf.WriteString(fmt.Sprintf("\t!%d !%d !%d", a, b, c))
+		case yo.OpTrybegin:
+			a, sbx := yo.OpGetA(instr), yo.OpGetsBx(instr)
+			buf.WriteString(fmt.Sprintf("!%d ->%d", a, pc+sbx))
+		case yo.OpDefer, yo.OpGo:
+			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			args := fmt.Sprintf("#%d", c&yo.OpCallArgsMask)
+			if c&yo.OpCallSpread != 0 {
+				args += "..."
+			}
+			if c&yo.OpCallKwargs != 0 {
+				args += " kw"
+			}
+			buf.WriteString(fmt.Sprintf("\t!%d #%d %s", a, b, args))
+		case yo.OpRecover, yo.OpYield, yo.OpClose:
+			buf.WriteString(fmt.Sprintf("\t!%d", yo.OpGetA(instr)))
+		case yo.OpMakechan:
+			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
+			buf.WriteString(fmt.Sprintf("!%d %s", a, getRegOrConst(b)))
+		case yo.OpSend:
+			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d %s", a, getRegOrConst(b)))
+		case yo.OpRecv:
+			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d !%d #%d", a, b, c))
+		case yo.OpSelect:
+			a, bx := yo.OpGetA(instr), yo.OpGetBx(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d %s", a, f.Consts[bx]))
+		case yo.OpPanic:
+			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d #%d", a, b))
 		}
 
 		buf.WriteString("\n")
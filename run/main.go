@@ -35,5 +35,7 @@ func main() {
 	fmt.Println(pretty.Disasm(code))
 
 	vm := yo.NewVM()
-	vm.RunBytecode(code)
+	if err := vm.RunBytecode(code); err != nil {
+		fmt.Println(err.Error())
+	}
 }
@@ -4,6 +4,8 @@ package yo
 
 import (
 	"fmt"
+	"reflect"
+	"unsafe"
 )
 
 type (
@@ -30,6 +32,12 @@ type (
 		// ToBool converts the value to a boolean value.
 		// If it's is nil or false it returns false, otherwise returns true.
 		ToBool() bool
+
+		// Export returns the natural Go value of this value: nil, bool,
+		// float64, string, []interface{} or map[string]interface{}, the
+		// other values are returned as they are. Arrays and objects
+		// which contain themselves become slices and maps which do.
+		Export() interface{}
 	}
 
 	// Nil represents the absence of a usable value.
@@ -51,6 +59,7 @@ type (
 	// Func is a function defined in the script.
 	Func struct {
 		Bytecode *Bytecode
+		upvalues []*upvalue
 	}
 
 	// Array is a collection of Values stored contiguously in memory,
@@ -70,11 +79,29 @@ type (
 	GoObject struct {
 		Object
 		Data interface{}
+
+		// the Go value of VM.WrapObject, see goobject.go
+		ptr     reflect.Value
+		info    *typeInfo
+		methods map[string]Value // the methods bound to ptr, made on demand
 	}
 
 	// Chan is an object that allows goroutines to
 	// communicate/send Values to one another.
 	Chan chan Value
+
+	// Generator is made by calling a function which yields, the
+	// function runs lazily, until the next yield, as each value is
+	// asked for by a for-in loop or by Next.
+	Generator struct {
+		vm      *VM
+		frame   *callFrame // the suspended frame of the function
+		spare   *callFrame // the frame of the stack replaced by frame while it runs
+		value   Value      // the value yielded and not taken yet
+		ready   bool
+		running bool
+		done    bool
+	}
 )
 
 const (
@@ -87,10 +114,11 @@ const (
 	ValueArray
 	ValueObject
 	ValueChan
+	ValueGenerator
 )
 
 var (
-	valueTypeNames = [9]string{"nil", "bool", "number", "string", "func", "func", "array", "object", "chan"}
+	valueTypeNames = [10]string{"nil", "bool", "number", "string", "func", "func", "array", "object", "chan", "generator"}
 )
 
 func (t ValueType) String() string {
@@ -109,6 +137,8 @@ func (v Nil) String() string {
 	return "nil"
 }
 
+func (v Nil) Export() interface{} { return nil }
+
 // Bool
 
 func (v Bool) assertFloat64() (float64, bool) { return 0, false }
@@ -124,6 +154,8 @@ func (v Bool) String() string {
 	return "false"
 }
 
+func (v Bool) Export() interface{} { return bool(v) }
+
 // Number
 
 func (v Number) assertFloat64() (float64, bool) { return float64(v), true }
@@ -136,6 +168,8 @@ func (v Number) String() string {
 	return fmt.Sprint(float64(v))
 }
 
+func (v Number) Export() interface{} { return float64(v) }
+
 // String
 
 func (v String) assertFloat64() (float64, bool) { return 0, false }
@@ -148,6 +182,8 @@ func (v String) String() string {
 	return string(v)
 }
 
+func (v String) Export() interface{} { return string(v) }
+
 // GoFunc
 
 func (v GoFunc) assertFloat64() (float64, bool) { return 0, false }
@@ -158,6 +194,8 @@ func (v GoFunc) Type() ValueType { return ValueGoFunc }
 func (v GoFunc) ToBool() bool    { return true }
 func (v GoFunc) String() string  { return "func" }
 
+func (v GoFunc) Export() interface{} { return v }
+
 // Func
 
 func (v Func) assertFloat64() (float64, bool) { return 0, false }
@@ -168,6 +206,8 @@ func (v Func) Type() ValueType { return ValueFunc }
 func (v Func) ToBool() bool    { return true }
 func (v Func) String() string  { return "func" }
 
+func (v *Func) Export() interface{} { return v }
+
 // Array
 
 func (v Array) assertFloat64() (float64, bool) { return 0, false }
@@ -180,6 +220,10 @@ func (v Array) String() string  {
 	return fmt.Sprintf("%v", []Value(v))
 }
 
+func (v *Array) Export() interface{} {
+	return exportValue(v, make(map[interface{}]interface{}))
+}
+
 // Object
 
 func (v *Object) assertFloat64() (float64, bool) { return 0, false }
@@ -192,9 +236,170 @@ func (v *Object) String() string  {
 	return fmt.Sprintf("%v", v.Fields)
 }
 
+func (v *Object) Export() interface{} {
+	return exportValue(v, make(map[interface{}]interface{}))
+}
+
+// GoObject
+
+func (v *GoObject) String() string {
+	if v.ptr.IsValid() {
+		return fmt.Sprintf("%v", v.ptr.Elem().Interface())
+	}
+	return v.Object.String()
+}
+
+// Export returns the host data of the object.
+func (v *GoObject) Export() interface{} { return v.Data }
+
+// Chan
+
+func (v Chan) assertFloat64() (float64, bool) { return 0, false }
+func (v Chan) assertBool() (bool, bool)       { return false, false }
+func (v Chan) assertString() (string, bool)   { return "", false }
+
+func (v Chan) Type() ValueType { return ValueChan }
+func (v Chan) ToBool() bool    { return true }
+func (v Chan) String() string  { return "chan" }
+
+func (v Chan) Export() interface{} { return v }
+
+// Generator
+
+func (v *Generator) assertFloat64() (float64, bool) { return 0, false }
+func (v *Generator) assertBool() (bool, bool)       { return false, false }
+func (v *Generator) assertString() (string, bool)   { return "", false }
+
+func (v *Generator) Type() ValueType { return ValueGenerator }
+func (v *Generator) ToBool() bool    { return true }
+func (v *Generator) String() string  { return "generator" }
+
+func (v *Generator) Export() interface{} { return v }
+
 func NewObject(parent *Object, fields map[string]Value) *Object {
 	return &Object{
 		Parent: parent,
 		Fields: fields,
 	}
 }
+
+// NewGoObject creates an object which carries host data, methods
+// can be exposed to the script by setting GoFunc fields, they receive
+// the object itself in FuncCall.This.
+func NewGoObject(parent *Object, fields map[string]Value, data interface{}) *GoObject {
+	return &GoObject{
+		Object: Object{Parent: parent, Fields: fields},
+		Data:   data,
+	}
+}
+
+// Get looks for the key in the object's own fields and,
+// if it's not there, in it's parents.
+func (v *Object) Get(key string) (Value, bool) {
+	for obj := v; obj != nil; obj = obj.Parent {
+		if field, ok := obj.Fields[key]; ok {
+			return field, true
+		}
+	}
+	return nil, false
+}
+
+// Set always sets the key in the object's own fields.
+func (v *Object) Set(key string, value Value) {
+	if v.Fields == nil {
+		v.Fields = make(map[string]Value)
+	}
+	v.Fields[key] = value
+}
+
+// Equality
+
+// a pair of arrays or objects being compared by valuesEqual
+type visit struct {
+	a, b interface{}
+}
+
+// valuesEqual reports whether a and b are equal. Values of different
+// types are never equal, arrays are equal if they have the same length
+// and equal elements, objects are equal if they have the same parent
+// and equal own fields. Functions and host objects are only equal
+// to themselves, or to the objects wrapping the same Go value.
+func valuesEqual(a, b Value) bool {
+	return deepEqual(a, b, nil)
+}
+
+// the function value itself, unlike reflect's Pointer which
+// is the same for every closure made by a function literal
+func funcIdentity(fn GoFunc) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&fn))
+}
+
+func deepEqual(a, b Value, visited map[visit]bool) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch va := a.(type) {
+	case Nil:
+		return true
+	case Bool:
+		return va == b.(Bool)
+	case Number:
+		return va == b.(Number)
+	case String:
+		return va == b.(String)
+	case GoFunc:
+		return funcIdentity(va) == funcIdentity(b.(GoFunc))
+	case *Func:
+		return va == b
+	case *GoObject:
+		vb, ok := b.(*GoObject)
+		if ok && va.ptr.IsValid() && vb.ptr.IsValid() {
+			return va.ptr.Pointer() == vb.ptr.Pointer() && va.ptr.Type() == vb.ptr.Type()
+		}
+		return va == b
+	case Chan:
+		return va == b.(Chan)
+	case *Generator:
+		return va == b
+	case *Array:
+		vb, ok := b.(*Array)
+		if !ok || len(*va) != len(*vb) {
+			return false
+		}
+		if va == vb || visited[visit{va, vb}] {
+			// the same array, or a cycle that's already being compared
+			return true
+		}
+		if visited == nil {
+			visited = make(map[visit]bool)
+		}
+		visited[visit{va, vb}] = true
+		for i := range *va {
+			if !deepEqual((*va)[i], (*vb)[i], visited) {
+				return false
+			}
+		}
+		return true
+	case *Object:
+		vb, ok := b.(*Object)
+		if !ok || va.Parent != vb.Parent || len(va.Fields) != len(vb.Fields) {
+			return false
+		}
+		if va == vb || visited[visit{va, vb}] {
+			return true
+		}
+		if visited == nil {
+			visited = make(map[visit]bool)
+		}
+		visited[visit{va, vb}] = true
+		for k, v := range va.Fields {
+			w, ok := vb.Fields[k]
+			if !ok || !deepEqual(v, w, visited) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
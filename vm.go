@@ -1,51 +1,243 @@
 package yo
 
 import (
-	"math"
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/glhrmfrts/yo/parse"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 const (
-	MaxRegisters  = 249
-	CallStackSize = 255
+	MaxRegisters     = 249
+	CallStackSize    = 255
+	GoroutineQuantum = 1000 // instructions a goroutine runs before giving way to the others
 )
 
 type opHandler func(*VM, *callFrame, uint32) int
 
 var opTable [kOpCount]opHandler
 
+// A variable captured by a closure, it points to the register
+// while the variable's frame is alive (open) and holds the value itself
+// after the frame returns (closed)
+type upvalue struct {
+	ref   *Value
+	value Value
+	index uint
+}
+
+// a try handler installed by OpTrybegin
+type tryHandler struct {
+	pc  int  // where the execution continues when a panic is caught
+	reg uint // register which receives the panicked value
+}
+
+// a call recorded by OpDefer or OpGo, it runs later
+type pendingCall struct {
+	fn     Value
+	this   Value
+	args   []Value
+	kwargs map[string]Value
+}
+
 type callFrame struct {
-	pc         int
-	line       int
-	canRecover bool
-	fn         *Func
-	r          [MaxRegisters]Value
+	pc       int
+	handlers []tryHandler // active try handlers, innermost last
+	fn       *Func
+	r        [MaxRegisters]Value
+	upvalues []*upvalue // open upvalues pointing to this frame's registers
+	gofn     GoFunc     // the host function being called by this frame, if any
+	gen      *Generator // the generator which this frame runs, if any
+
+	// where the host which called this frame gets all of its results, see VM.Call
+	hostResults *[]Value
+
+	// where the results of this call should be stored
+	// in the caller's registers, see OpReturn
+	resultReg  uint
+	numResults uint
+
+	// panics caught by this frame's handlers, by the register
+	// which received them, so they can be rethrown untouched
+	caught map[uint]*RuntimeError
+
+	defers    []pendingCall // run in reverse order when the frame returns
+	deferred  bool          // this frame runs a deferred call of its caller
+	panic     *RuntimeError // the panic unwinding this frame while it runs its deferred calls
+	recovered bool          // the panic was recovered by a deferred call
 }
 
+// the frames are allocated as the stack grows, and are
+// never moved, so upvalues can point to their registers
 type callFrameStack struct {
 	sp    int
-	stack [CallStackSize]callFrame
+	stack []*callFrame
+}
+
+func (uv *upvalue) close() {
+	uv.value = *uv.ref
+	uv.ref = &uv.value
+}
+
+// get the open upvalue for register 'index', so all the closures
+// which capture the same variable share it
+func (cf *callFrame) upvalue(index uint) *upvalue {
+	for _, uv := range cf.upvalues {
+		if uv.index == index {
+			return uv
+		}
+	}
+	uv := &upvalue{ref: &cf.r[index], index: index}
+	cf.upvalues = append(cf.upvalues, uv)
+	return uv
+}
+
+func (cf *callFrame) closeUpvalues() {
+	cf.closeUpvaluesFrom(0)
+}
+
+// close the upvalues of the registers from 'reg' upwards, so
+// the closures keep the values after the registers are reused
+func (cf *callFrame) closeUpvaluesFrom(reg uint) {
+	open := cf.upvalues[:0]
+	for _, uv := range cf.upvalues {
+		if uv.index >= reg {
+			uv.close()
+		} else {
+			open = append(open, uv)
+		}
+	}
+	for i := len(open); i < len(cf.upvalues); i++ {
+		cf.upvalues[i] = nil
+	}
+	cf.upvalues = open
 }
 
 func (stack *callFrameStack) New() *callFrame {
+	if stack.sp == len(stack.stack) {
+		stack.stack = append(stack.stack, &callFrame{})
+	}
 	stack.sp += 1
-	return &stack.stack[stack.sp-1]
+	cf := stack.stack[stack.sp-1]
+	cf.pc = 0
+	cf.handlers = cf.handlers[:0]
+	cf.resultReg = 0
+	cf.numResults = 0
+	cf.gofn = nil
+	cf.gen = nil
+	cf.hostResults = nil
+	cf.caught = nil
+	cf.defers = cf.defers[:0]
+	cf.deferred = false
+	cf.panic = nil
+	cf.recovered = false
+	return cf
+}
+
+func (stack *callFrameStack) Pop() *callFrame {
+	if stack.sp == 0 {
+		return nil
+	}
+	stack.sp -= 1
+	return stack.stack[stack.sp]
+}
+
+// push a frame which lives out of the stack, like the frame of a
+// generator, the frame it replaces is returned to be put back by detach
+func (stack *callFrameStack) push(cf *callFrame) *callFrame {
+	var spare *callFrame
+	if stack.sp == len(stack.stack) {
+		stack.stack = append(stack.stack, cf)
+	} else {
+		spare = stack.stack[stack.sp]
+		stack.stack[stack.sp] = cf
+	}
+	stack.sp += 1
+	return spare
+}
+
+// pop the frame pushed by push, which stays alive out of the stack
+func (stack *callFrameStack) detach(spare *callFrame) *callFrame {
+	stack.sp -= 1
+	cf := stack.stack[stack.sp]
+	if spare != nil {
+		stack.stack[stack.sp] = spare
+	} else {
+		stack.stack = stack.stack[:stack.sp]
+	}
+	return cf
 }
 
 func (stack *callFrameStack) Last() *callFrame {
 	if stack.sp == 0 {
 		return nil
 	}
-	return &stack.stack[stack.sp-1]
+	return stack.stack[stack.sp-1]
+}
+
+// An entry in the traceback of a RuntimeError
+type StackEntry struct {
+	Func string
+	File string
+	Line int
+	IsGo bool // the function is a GoFunc, File and Line are not set
+}
+
+// RuntimeError is returned when the execution of a script fails,
+// File and Line are the location of the error in the script (File
+// is empty if no script was running, like in the failed calls of the
+// host) and Traceback contains the calls that were active, innermost first.
+// Value is what a recover block receives: the value given to panic,
+// or the message for errors raised by the VM.
+type RuntimeError struct {
+	Message   string
+	File      string
+	Line      int
+	Traceback []StackEntry
+	Value     Value
+}
+
+func (err *RuntimeError) Error() string {
+	var buf bytes.Buffer
+	if err.File != "" {
+		buf.WriteString(fmt.Sprintf("%s:%d: ", err.File, err.Line))
+	}
+	buf.WriteString(err.Message)
+	if len(err.Traceback) > 0 {
+		buf.WriteString("\ntraceback:")
+	}
+	for _, e := range err.Traceback {
+		if e.IsGo {
+			buf.WriteString(fmt.Sprintf("\n\t[Go]: in %s", e.Func))
+		} else {
+			buf.WriteString(fmt.Sprintf("\n\t%s:%d: in %s", e.File, e.Line, e.Func))
+		}
+	}
+	return buf.String()
 }
 
 type FuncCall struct {
 	Args          []Value
+	KwArgs        map[string]Value // keyword arguments by name, nil if there are none
+	This          Value            // the receiver when called as a method, nil otherwise
 	ExpectResults uint
 	NumArgs       uint
 	NumResults    uint
 
+	// the name of the global or of the field which the script called,
+	// or of the builtin, it's empty when it's not known
+	Name string
+
 	results []Value
+	err     error
+	vm      *VM
 }
 
 func (c *FuncCall) PushReturnValue(v Value) {
@@ -53,18 +245,175 @@ func (c *FuncCall) PushReturnValue(v Value) {
 	c.NumResults++
 }
 
+// Error makes the call fail with a runtime error after the function
+// returns, the script can recover from it like from a panic. The error
+// of a nested Call wrapped with %w is kept as it is, e.g.:
+//   call.Error("%w", err)
+func (c *FuncCall) Error(format string, args ...interface{}) {
+	c.err = fmt.Errorf(format, args...)
+}
+
+// Check makes the call fail if it has less than 'n' arguments,
+// the result is false if it does.
+func (c *FuncCall) Check(n int) bool {
+	if int(c.NumArgs) < n {
+		c.fail("expected at least %s, got %d", arguments(n), c.NumArgs)
+		return false
+	}
+	return true
+}
+
+// Number returns the argument 'i', counted from 0, if it's a number,
+// otherwise the call fails with an error which tells the position of
+// the argument, and the bool result is false. The other argument
+// helpers work the same way.
+func (c *FuncCall) Number(i int) (float64, bool) {
+	n, ok := c.arg(i).assertFloat64()
+	if !ok {
+		c.badArg(i, "a number")
+	}
+	return n, ok
+}
+
+// OptNumber is like Number, but returns 'def' when the argument is nil or missing.
+func (c *FuncCall) OptNumber(i int, def float64) (float64, bool) {
+	if c.arg(i).Type() == ValueNil {
+		return def, true
+	}
+	return c.Number(i)
+}
+
+// String returns the argument 'i' if it's a string, see Number.
+func (c *FuncCall) String(i int) (string, bool) {
+	s, ok := c.arg(i).assertString()
+	if !ok {
+		c.badArg(i, "a string")
+	}
+	return s, ok
+}
+
+// Array returns the argument 'i' if it's an array, see Number.
+func (c *FuncCall) Array(i int) (*Array, bool) {
+	arr, ok := c.arg(i).(*Array)
+	if !ok {
+		c.badArg(i, "an array")
+	}
+	return arr, ok
+}
+
+// Object returns the argument 'i' if it's an object, see Number.
+func (c *FuncCall) Object(i int) (*Object, bool) {
+	obj, ok := toObject(c.arg(i))
+	if !ok {
+		c.badArg(i, "an object")
+	}
+	return obj, ok
+}
+
+// OptObject is like Object, but returns nil when the argument is nil or missing.
+func (c *FuncCall) OptObject(i int) (*Object, bool) {
+	if c.arg(i).Type() == ValueNil {
+		return nil, true
+	}
+	return c.Object(i)
+}
+
+// Chan returns the argument 'i' if it's a channel, see Number.
+func (c *FuncCall) Chan(i int) (Chan, bool) {
+	ch, ok := c.arg(i).(Chan)
+	if !ok {
+		c.badArg(i, "a chan")
+	}
+	return ch, ok
+}
+
+// get the argument 'i', nil if it's missing
+func (c *FuncCall) arg(i int) Value {
+	if i < 0 || i >= int(c.NumArgs) {
+		return Nil{}
+	}
+	return c.Args[i]
+}
+
+// make the call fail because the argument 'i' is not 'expected'
+func (c *FuncCall) badArg(i int, expected string) {
+	got := "no value"
+	if i >= 0 && i < int(c.NumArgs) {
+		got = c.Args[i].Type().String()
+	}
+	c.fail("argument %d: expected %s, got %s", i+1, expected, got)
+}
+
+// make the call fail with an error which starts with the name of the function
+func (c *FuncCall) fail(format string, args ...interface{}) {
+	if c.Name != "" {
+		format = c.Name + ": " + format
+	}
+	c.Error(format, args...)
+}
+
+// get "1 argument" or "n arguments"
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
 type VM struct {
-	Globals      map[string]Value
+	Globals map[string]Value
 
 	currentFrame *callFrame
 	calls        callFrameStack
 	error        error
+
+	// goroutines, see goroutine.go
+	sched *scheduler // nil if no script is running
+	seed  int64
+	steps int // instructions left in the quantum of the running goroutine
 }
 
 func (vm *VM) Define(name string, v Value) {
 	vm.Globals[name] = v
 }
 
+func (vm *VM) setError(format string, args ...interface{}) {
+	vm.error = vm.newRuntimeError(fmt.Sprintf(format, args...))
+}
+
+// the runtime error of a failed host function, the error of a Call
+// which it made is already one, with the traceback of the whole stack
+func (vm *VM) goFuncError(err error) *RuntimeError {
+	var rerr *RuntimeError
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+	return vm.newRuntimeError(err.Error())
+}
+
+// create an error with the traceback of the current call stack
+func (vm *VM) newRuntimeError(msg string) *RuntimeError {
+	err := &RuntimeError{Message: msg, Value: String(msg)}
+	for i := vm.calls.sp - 1; i >= 0; i-- {
+		cf := vm.calls.stack[i]
+		if cf.gofn != nil {
+			err.Traceback = append(err.Traceback, StackEntry{Func: goFuncName(cf.gofn), IsGo: true})
+		}
+		if cf.fn == nil {
+			// the frame of a call made by the VM, see VM.call
+			continue
+		}
+
+		proto := cf.fn.Bytecode
+		entry := StackEntry{Func: funcName(proto), File: proto.Source, Line: proto.lineAt(cf.pc - 1)}
+		if err.File == "" {
+			err.File, err.Line = entry.File, entry.Line
+		}
+		err.Traceback = append(err.Traceback, entry)
+	}
+	return err
+}
+
 func (vm *VM) RunString(source []byte, filename string) error {
 	nodes, err := parse.ParseFile(source, filename)
 	if err != nil {
@@ -79,16 +428,101 @@ func (vm *VM) RunString(source []byte, filename string) error {
 	return vm.RunBytecode(code)
 }
 
+// RunBytecode runs the main function of a compiled script and
+// returns when it returns, the goroutines it started are discarded
 func (vm *VM) RunBytecode(b *Bytecode) error {
+	base := vm.calls.sp
 	vm.currentFrame = vm.calls.New()
-	vm.currentFrame.fn = &Func{b}
+	vm.currentFrame.fn = &Func{Bytecode: b}
+
+	return vm.run(base)
+}
+
+// Call calls the function 'fn' with the arguments 'args' and returns all
+// of its results, the errors of the call are returned as *RuntimeError.
+// It can be called by host functions while a script runs, then the
+// goroutine which called the host function can't give way to the others
+// until the call returns, otherwise the goroutines started by the
+// call are discarded when it returns, like the ones of RunBytecode.
+func (vm *VM) Call(fn Value, args ...Value) ([]Value, error) {
+	// the frame of the host, like the ones of the host functions
+	base := vm.calls.sp
+	cf := vm.calls.New()
+	cf.fn = nil
+	defer func() {
+		vm.calls.Pop()
+		vm.currentFrame = vm.calls.Last()
+	}()
+
+	var results []Value
+	switch f := fn.(type) {
+	case GoFunc:
+		call := FuncCall{Args: append([]Value(nil), args...), This: Nil{}, NumArgs: uint(len(args)), Name: builtinName(f), vm: vm}
+		cf.gofn = f
+		f(&call)
+		if call.err != nil {
+			return nil, vm.goFuncError(call.err)
+		}
+		return call.results, nil
+	case *Func:
+		// a generator is the only result when no frame is pushed
+		if callFunc(vm, cf, f, Nil{}, 0, 1, args, nil) == 1 {
+			err := vm.error
+			vm.error = nil
+			return nil, err
+		}
+		if vm.calls.sp == base+1 {
+			results = []Value{cf.r[0]}
+		} else {
+			vm.currentFrame.hostResults = &results
+			if err := vm.run(base + 1); err != nil {
+				return nil, err
+			}
+		}
+		// called by a host function while the script runs
+		for _, v := range results {
+			vm.escape(v)
+		}
+		return results, nil
+	}
+	return nil, vm.newRuntimeError(fmt.Sprintf("attempt to call a %s value", fn.Type()))
+}
+
+// CallGlobal calls the function in the global 'name', see Call.
+func (vm *VM) CallGlobal(name string, args ...Value) ([]Value, error) {
+	fn, ok := vm.Globals[name]
+	if !ok {
+		return nil, vm.newRuntimeError(fmt.Sprintf("undefined global %s", name))
+	}
+	return vm.Call(fn, args...)
+}
 
-	return mainLoop(vm)
+// run the frames above 'base' until they return
+func (vm *VM) run(base int) error {
+	var err error
+	if vm.sched == nil {
+		err = vm.schedule(base)
+	} else {
+		// called by a host function, the goroutine can't
+		// give way to the others until it returns
+		vm.sched.nested++
+		err = mainLoop(vm, base)
+		vm.sched.nested--
+	}
+	if err != nil {
+		// discard the frames left by the failed execution
+		for vm.calls.sp > base {
+			vm.popFrame().closeUpvalues()
+		}
+		vm.currentFrame = vm.calls.Last()
+	}
+	return err
 }
 
 func NewVM() *VM {
 	vm := &VM{
 		Globals: make(map[string]Value, 128),
+		seed:    time.Now().UnixNano(),
 	}
 
 	defineBuiltins(vm)
@@ -117,19 +551,24 @@ func init() {
 			if g, ok := vm.Globals[str]; ok {
 				cf.r[a] = g
 			} else {
-				//vm.setError("undefined global %s", str)
+				vm.setError("undefined global %s", str)
 				return 1
 			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetGlobal
-			// TODO: remove this instruction
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			vm.Globals[cf.fn.Bytecode.Consts[bx].String()] = cf.r[a]
 			return 0
 		},
-		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadRef
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadFree
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			cf.r[a] = *cf.fn.upvalues[bx].ref
 			return 0
 		},
-		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetRef
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetFree
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			*cf.fn.upvalues[bx].ref = cf.r[a]
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpUnm
@@ -142,7 +581,7 @@ func init() {
 			}
 			f, ok := bv.assertFloat64()
 			if !ok {
-				//vm.setError("cannot perform unary minus on %s", bv.Type())
+				vm.setError("cannot perform unary minus on %s", bv.Type())
 				return 1
 			}
 			cf.r[a] = Number(-f)
@@ -168,11 +607,11 @@ func init() {
 				bv = cf.r[bx]
 			}
 			f, ok := bv.assertFloat64()
-			if !ok || isInt(f) {
-				//vm.setError("cannot perform complement on %s", bv.Type())
+			if !ok || !isInt(f) {
+				vm.setError("cannot perform complement on %s", bv.Type())
 				return 1
 			}
-			cf.r[a] = Number(float64(^int(f)))
+			cf.r[a] = Number(float64(^int64(f)))
 			return 0
 		},
 		opArith, // OpAdd
@@ -180,6 +619,8 @@ func init() {
 		opArith, // OpMul
 		opArith, // OpDiv
 		opArith, // OpPow
+		opArith, // OpMod
+		opArith, // OpIntdiv
 		opArith, // OpShl
 		opArith, // OpShr
 		opArith, // OpAnd
@@ -196,49 +637,93 @@ func init() {
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpGetIndex
 			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
-			v := cf.r[b]
-			if v.Type() == ValueArray {
-				var index Value
-				if c >= OpConstOffset {
-					index = cf.fn.Bytecode.Consts[c - OpConstOffset]
-				} else {
-					index = cf.r[c]
-				}
-
-				arr := []Value(v.(Array))
-				n, ok := index.assertFloat64()
-				if !ok {
-					// panic
-					return 1
-				}
-
-				cf.r[a] = arr[int(n)]
+			var index Value
+			if c >= OpConstOffset {
+				index = cf.fn.Bytecode.Consts[c-OpConstOffset]
+			} else {
+				index = cf.r[c]
 			}
-
+			v, ok := getIndex(vm, cf.r[b], index)
+			if !ok {
+				return 1
+			}
+			cf.r[a] = v
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetIndex
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			var index, v Value
+			if b >= OpConstOffset {
+				index = cf.fn.Bytecode.Consts[b-OpConstOffset]
+			} else {
+				index = cf.r[b]
+			}
+			if c >= OpConstOffset {
+				v = cf.fn.Bytecode.Consts[c-OpConstOffset]
+			} else {
+				v = cf.r[c]
+			}
+			if !setIndex(vm, cf.r[a], index, v) {
+				return 1
+			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpAppend
 			a, b := OpGetA(instr), OpGetB(instr)
 			from := a + 1
 			to := from + b
-			ptr := cf.r[a]
-			arr := ptr.(*Array)
+			arr, ok := cf.r[a].(*Array)
+			if !ok {
+				vm.setError("cannot append to %s", cf.r[a].Type())
+				return 1
+			}
 			*arr = append(*arr, cf.r[from:to]...)
 			return 0
 		},
-		func(vm *VM, cf *callFrame, instr uint32) int { // OpCall
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSlice
 			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
-			fn := cf.r[a]
-			if fn.Type() == ValueGoFunc {
-				callGoFunc(vm, cf, fn.(GoFunc), a, b, c)
+			v, ok := sliceValue(vm, cf.r[b], cf.r[c], cf.r[c+1])
+			if !ok {
+				return 1
 			}
+			cf.r[a] = v
 			return 0
 		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpCall
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			args, kwargs, ok := callArgs(vm, cf, a+b, c)
+			if !ok {
+				return 1
+			}
+			switch fn := cf.r[a].(type) {
+			case GoFunc:
+				return callGoFunc(vm, cf, fn, cf.fn.Bytecode.CallNames[cf.pc-1], Nil{}, a, b, args, kwargs)
+			case *Func:
+				return callFunc(vm, cf, fn, Nil{}, a, b, args, kwargs)
+			default:
+				vm.setError("attempt to call a %s value", cf.r[a].Type())
+				return 1
+			}
+		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpCallMethod
-			return 0
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+
+			// the receiver is the first argument, it's not passed
+			// as a regular argument but bound to 'this'
+			this := cf.r[a+b]
+			args, kwargs, ok := callArgs(vm, cf, a+b+1, c-1)
+			if !ok {
+				return 1
+			}
+			switch fn := cf.r[a].(type) {
+			case GoFunc:
+				return callGoFunc(vm, cf, fn, cf.fn.Bytecode.CallNames[cf.pc-1], this, a, b, args, kwargs)
+			case *Func:
+				return callFunc(vm, cf, fn, this, a, b, args, kwargs)
+			default:
+				vm.setError("attempt to call a %s value as a method of %s", cf.r[a].Type(), this.Type())
+				return 1
+			}
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpArray
 			arr := Array([]Value{})
@@ -250,6 +735,20 @@ func init() {
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpFunc
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			proto := cf.fn.Bytecode.Funcs[bx]
+			fn := &Func{Bytecode: proto}
+			if proto.NumUpvalues > 0 {
+				fn.upvalues = make([]*upvalue, proto.NumUpvalues)
+				for i, desc := range proto.Upvalues {
+					if desc.Instack {
+						fn.upvalues[i] = cf.upvalue(uint(desc.Index))
+					} else {
+						fn.upvalues[i] = cf.fn.upvalues[desc.Index]
+					}
+				}
+			}
+			cf.r[a] = fn
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpJmp
@@ -282,16 +781,336 @@ func init() {
 			}
 			return 0
 		},
-		func(vm *VM, cf *callFrame, instr uint32) int { // OpReturn
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSwitch
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			switch val := cf.r[a].(type) {
+			case Number, String:
+				if offset, ok := cf.fn.Bytecode.JumpTables[bx][val]; ok {
+					cf.pc += offset
+				}
+			}
 			return 0
 		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpReturn
+			if len(cf.defers) > 0 {
+				// run this instruction again after the deferred call
+				cf.pc--
+				return runDeferred(vm, cf)
+			}
+			return returnFrame(vm, cf, OpGetA(instr), OpGetB(instr))
+		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpForBegin
+			a, b := OpGetA(instr), OpGetB(instr)
+			switch col := cf.r[b].(type) {
+			case *Array, String, Chan, *Generator:
+				cf.r[a] = col
+			default:
+				if g, ok := col.(*GoObject); ok && g.goKind() == reflect.Slice {
+					cf.r[a] = col
+					break
+				}
+				obj, ok := toObject(col)
+				if !ok {
+					vm.setError("cannot iterate over a %s value", col.Type())
+					return 1
+				}
+
+				// objects are iterated in the order of their keys
+				names := make([]string, 0, len(obj.Fields))
+				for k := range obj.Fields {
+					names = append(names, k)
+				}
+				if g, ok := col.(*GoObject); ok {
+					names = append(names, g.goKeys()...)
+				}
+				sort.Strings(names)
+
+				keys := make(Array, len(names))
+				for i, k := range names {
+					keys[i] = String(k)
+				}
+				cf.r[a] = &keys
+			}
+			cf.r[a+1] = Number(0)
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpForIter
+			// arrays yield (index, element), strings yield (byte offset, rune)
+			// objects yield (key, value) of their own fields, sorted by key,
+			// along with the fields of the Go values wrapped by them,
+			// channels yield (count, value) until they're closed and
+			// generators yield (count, value) until their function returns
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			i := int(cf.r[a+1].(Number))
+			switch col := cf.r[b].(type) {
+			case *Array:
+				if i >= len(*col) {
+					return 0
+				}
+				cf.r[c], cf.r[c+1] = Number(i), (*col)[i]
+				i++
+			case String:
+				if i >= len(col) {
+					return 0
+				}
+				r, size := utf8.DecodeRuneInString(string(col[i:]))
+				cf.r[c], cf.r[c+1] = Number(i), String(string(r))
+				i += size
+			case Chan:
+				r, ok := vm.chanSelect(cf, []reflect.SelectCase{recvCase(col)}, true)
+				if !ok {
+					return 1
+				}
+				if r.chosen == chanWaiting || !r.ok {
+					return 0
+				}
+				cf.r[c], cf.r[c+1] = Number(i), r.value
+				i++
+			case *Generator:
+				v, ok := col.take()
+				if !ok {
+					if col.done {
+						return 0
+					}
+					if !col.resume(vm) {
+						return 1
+					}
+					// run again when the generator yields or returns
+					cf.pc--
+					return 0
+				}
+				cf.r[c], cf.r[c+1] = Number(i), v
+				i++
+			default:
+				g, isGo := col.(*GoObject)
+				if isGo && g.goKind() == reflect.Slice {
+					if i >= g.goLen() {
+						return 0
+					}
+					v, ok := g.getElem(vm, Number(i))
+					if !ok {
+						return 1
+					}
+					cf.r[c], cf.r[c+1] = Number(i), v
+					i++
+					break
+				}
+				obj, _ := toObject(col)
+				keys := *cf.r[a].(*Array)
+				if i >= len(keys) {
+					return 0
+				}
+				key := string(keys[i].(String))
+				value, ok := obj.Fields[key]
+				if !ok && isGo {
+					var err error
+					value, ok, err = g.getGo(key)
+					if err != nil {
+						vm.setError("%s", err)
+						return 1
+					}
+				}
+				if !ok {
+					value = Nil{}
+				}
+				cf.r[c], cf.r[c+1] = keys[i], value
+				i++
+			}
+			cf.r[a+1] = Number(i)
+			cf.pc++ // skip the jump out of the loop
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpTrybegin
+			a, sbx := OpGetA(instr), OpGetsBx(instr)
+			cf.handlers = append(cf.handlers, tryHandler{pc: cf.pc + sbx, reg: a})
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpTryend
+			cf.handlers = cf.handlers[:len(cf.handlers)-1]
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpPanic
+			a, b := OpGetA(instr), OpGetB(instr)
+			if b == 1 {
+				if err, ok := cf.caught[a]; ok {
+					delete(cf.caught, a)
+					vm.error = err
+					return 1
+				}
+			}
+			v := cf.r[a]
+			err := vm.newRuntimeError(v.String())
+			err.Value = v
+			vm.error = err
+			return 1
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpDefer
+			d, ok := makePendingCall(vm, cf, instr, "attempt to defer a call of a %s value")
+			if !ok {
+				return 1
+			}
+			cf.defers = append(cf.defers, d)
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpRecover
+			a := OpGetA(instr)
+			cf.r[a] = Nil{}
+
+			// only a deferred call can stop the panic of its caller
+			if cf.deferred && vm.calls.sp > 1 {
+				caller := vm.calls.stack[vm.calls.sp-2]
+				if caller.panic != nil {
+					cf.r[a] = caller.panic.Value
+					caller.panic = nil
+					caller.recovered = true
+				}
+			}
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpGo
+			g, ok := makePendingCall(vm, cf, instr, "attempt to start a goroutine with a %s value")
+			if !ok {
+				return 1
+			}
+			vm.goroutine(g)
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpMakechan
+			a, b := OpGetA(instr), OpGetB(instr)
+			var size Value
+			if b >= OpConstOffset {
+				size = cf.fn.Bytecode.Consts[b-OpConstOffset]
+			} else {
+				size = cf.r[b]
+			}
+			n, ok := size.assertFloat64()
+			if !ok || !isInt(n) || n < 0 {
+				vm.setError("channel size must be a non-negative integer, got %v", size)
+				return 1
+			}
+			ch := make(Chan, int(n))
+			if vm.sched != nil {
+				vm.sched.local[ch] = true
+			}
+			cf.r[a] = ch
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSend
+			a, b := OpGetA(instr), OpGetB(instr)
+			ch, ok := cf.r[a].(Chan)
+			if !ok {
+				vm.setError("cannot send to a %s value", cf.r[a].Type())
+				return 1
+			}
+			var v Value
+			if b >= OpConstOffset {
+				v = cf.fn.Bytecode.Consts[b-OpConstOffset]
+			} else {
+				v = cf.r[b]
+			}
+			if _, ok := vm.chanSelect(cf, []reflect.SelectCase{sendCase(ch, v)}, true); !ok {
+				return 1
+			}
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpRecv
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			ch, ok := cf.r[b].(Chan)
+			if !ok {
+				vm.setError("cannot receive from a %s value", cf.r[b].Type())
+				return 1
+			}
+			r, ok := vm.chanSelect(cf, []reflect.SelectCase{recvCase(ch)}, true)
+			if !ok {
+				return 1
+			}
+			if r.chosen == chanWaiting {
+				return 0
+			}
+			cf.r[a] = r.value
+			if c == 1 {
+				cf.r[a+1] = Bool(r.ok)
+			}
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSelect
+			// K(Bx) describes the cases with one character each, 'r'
+			// for a receive from R(A+3+i*2) and 's' for a send of
+			// R(A+4+i*2) to R(A+3+i*2), a trailing 'd' means there's a
+			// default case. R(A) is set to the index of the chosen case
+			// (-1 for the default), R(A+1) and R(A+2) to the received value and ok
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			desc := string(cf.fn.Bytecode.Consts[bx].(String))
+			block := true
+			if n := len(desc); n > 0 && desc[n-1] == 'd' {
+				desc, block = desc[:n-1], false
+			}
+
+			cases := make([]reflect.SelectCase, len(desc))
+			for i := range desc {
+				reg := a + 3 + uint(i)*2
+				ch, ok := cf.r[reg].(Chan)
+				if !ok {
+					if desc[i] == 's' {
+						vm.setError("cannot send to a %s value", cf.r[reg].Type())
+					} else {
+						vm.setError("cannot receive from a %s value", cf.r[reg].Type())
+					}
+					return 1
+				}
+				if desc[i] == 's' {
+					cases[i] = sendCase(ch, cf.r[reg+1])
+				} else {
+					cases[i] = recvCase(ch)
+				}
+			}
+
+			r, ok := vm.chanSelect(cf, cases, block)
+			if !ok {
+				return 1
+			}
+			if r.chosen == chanWaiting {
+				return 0
+			}
+			cf.r[a], cf.r[a+1], cf.r[a+2] = Number(r.chosen), r.value, Bool(r.ok)
 			return 0
 		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpYield
+			cf.gen.yield(vm, cf.r[OpGetA(instr)])
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpClose
+			cf.closeUpvaluesFrom(OpGetA(instr))
+			return 0
+		},
+	}
+}
+
+// get the call of OpDefer or OpGo, 'errFormat' is used when the
+// function is not callable
+func makePendingCall(vm *VM, cf *callFrame, instr uint32, errFormat string) (pendingCall, bool) {
+	a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+	p := pendingCall{fn: cf.r[a], this: Nil{}}
+	switch p.fn.(type) {
+	case GoFunc, *Func:
+	default:
+		vm.setError(errFormat, p.fn.Type())
+		return p, false
+	}
+
+	args := a + 1
+	if b == 1 {
+		p.this = cf.r[args]
+		args, c = args+1, c-1
 	}
+	list, kwargs, ok := callArgs(vm, cf, args, c)
+	if !ok {
+		return p, false
+	}
+	// the registers are reused until the call runs
+	p.args = append([]Value(nil), list...)
+	p.kwargs = kwargs
+	return p, true
 }
 
 func opArith(vm *VM, cf *callFrame, instr uint32) int {
@@ -309,37 +1128,74 @@ func opArith(vm *VM, cf *callFrame, instr uint32) int {
 	}
 	fb, okb := vb.assertFloat64()
 	fc, okc := vc.assertFloat64()
-	if okb && okc {
-		cf.r[a] = Number(numberArith(OpGetOpcode(instr), fb, fc))
+	if !(okb && okc) {
+		if sb, ok := vb.(String); ok && OpGetOpcode(instr) == OpAdd {
+			if sc, ok := vc.(String); ok {
+				cf.r[a] = sb + sc
+				return 0
+			}
+		}
+		vm.setError("cannot perform %s on %s and %s", OpGetOpcode(instr), vb.Type(), vc.Type())
+		return 1
 	}
+	res, err := numberArith(OpGetOpcode(instr), fb, fc)
+	if err != nil {
+		vm.setError("%s", err)
+		return 1
+	}
+	cf.r[a] = Number(res)
 	return 0
 }
 
-func numberArith(op Opcode, a, b float64) float64 {
+// % and integer division truncate towards zero like in Go, so the
+// result has the sign of the dividend, both also work with non-integers,
+// e.g. 7.5 % 2 == 1.5 and 7.5 ~/ 2 == 3. Bitwise operations only accept
+// integers and work on their two's complement representation.
+func numberArith(op Opcode, a, b float64) (float64, error) {
 	switch op {
 	case OpAdd:
-		return a + b
+		return a + b, nil
 	case OpSub:
-		return a - b
+		return a - b, nil
 	case OpMul:
-		return a * b
+		return a * b, nil
 	case OpDiv:
-		return a / b
+		return a / b, nil
 	case OpPow:
-		return math.Pow(a, b)
-	case OpShl:
-		return float64(uint(a) << uint(b))
-	case OpShr:
-		return float64(uint(a) >> uint(b))
+		return math.Pow(a, b), nil
+	case OpMod, OpIntdiv:
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		if op == OpMod {
+			return math.Mod(a, b), nil
+		}
+		return math.Trunc(a / b), nil
+	}
+
+	for _, n := range [2]float64{a, b} {
+		if !isInt(n) {
+			return 0, fmt.Errorf("cannot perform %s on non-integer %v", op, n)
+		}
+	}
+	x, y := int64(a), int64(b)
+	switch op {
+	case OpShl, OpShr:
+		if y < 0 {
+			return 0, fmt.Errorf("negative shift count %d", y)
+		}
+		if op == OpShl {
+			return float64(x << uint64(y)), nil
+		}
+		return float64(x >> uint64(y)), nil
 	case OpAnd:
-		return float64(uint(a) & uint(b))
+		return float64(x & y), nil
 	case OpOr:
-		return float64(uint(a) | uint(b))
+		return float64(x | y), nil
 	case OpXor:
-		return float64(uint(a) ^ uint(b))
-	default:
-		return 0
+		return float64(x ^ y), nil
 	}
+	return 0, fmt.Errorf("cannot perform %s on numbers", op)
 }
 
 func opCmp(vm *VM, cf *callFrame, instr uint32) int {
@@ -356,117 +1212,475 @@ func opCmp(vm *VM, cf *callFrame, instr uint32) int {
 		vc = cf.r[c]
 	}
 
-	if (vb.Type() != ValueNil && vc.Type() != ValueNil) && vb.Type() != vc.Type() {
-		cf.r[a] = Bool(false)
-		return 0
-	}
-
 	op := OpGetOpcode(instr)
 	var res bool
-	switch vb.Type() {
-	case ValueNil:
-		if op == OpEq || op == OpNe {
-			res = vc.Type() == ValueNil
-			if op == OpNe {
-				res = !res
-			}
-		} else {
-			// throw error
+	switch op {
+	case OpEq:
+		res = valuesEqual(vb, vc)
+	case OpNe:
+		res = !valuesEqual(vb, vc)
+	default:
+		// only numbers and strings are ordered
+		switch {
+		case vb.Type() == ValueNumber && vc.Type() == ValueNumber:
+			numb, _ := vb.assertFloat64()
+			numc, _ := vc.assertFloat64()
+			res = (op == OpLt && numb < numc) || (op == OpLe && numb <= numc)
+		case vb.Type() == ValueString && vc.Type() == ValueString:
+			sb, _ := vb.assertString()
+			sc, _ := vc.assertString()
+			res = (op == OpLt && sb < sc) || (op == OpLe && sb <= sc)
+		default:
+			vm.setError("cannot compare %s with %s", vb.Type(), vc.Type())
 			return 1
 		}
-	case ValueBool:
-		bb, _ := vb.assertBool()
-		bc, _ := vc.assertBool()
-		if eq, ne := op == OpEq, op == OpNe; eq || ne {
-			res = bb == bc
-			if ne {
-				res = !res
+	}
+	cf.r[a] = Bool(res)
+	return 0
+}
+
+// get the underlying *Object of an object value
+func toObject(v Value) (*Object, bool) {
+	switch o := v.(type) {
+	case *Object:
+		return o, true
+	case *GoObject:
+		return &o.Object, true
+	}
+	return nil, false
+}
+
+// check that 'index' is a valid index of a sequence with length n
+func sequenceIndex(vm *VM, kind string, n int, index Value) (int, bool) {
+	f, ok := index.assertFloat64()
+	if !ok || !isInt(f) {
+		vm.setError("%s index must be an integer, got %s", kind, index.Type())
+		return 0, false
+	}
+	i := int(f)
+	if i < 0 || i >= n {
+		vm.setError("%s index %d out of range [0:%d]", kind, i, n)
+		return 0, false
+	}
+	return i, true
+}
+
+func arrayIndex(vm *VM, arr Array, index Value) (int, bool) {
+	return sequenceIndex(vm, "array", len(arr), index)
+}
+
+// indexing a string yields the byte at the index, as a string
+func getIndex(vm *VM, v Value, index Value) (Value, bool) {
+	if arr, ok := v.(*Array); ok {
+		i, ok := arrayIndex(vm, *arr, index)
+		if !ok {
+			return nil, false
+		}
+		return (*arr)[i], true
+	}
+	if s, ok := v.(String); ok {
+		i, ok := sequenceIndex(vm, "string", len(s), index)
+		if !ok {
+			return nil, false
+		}
+		return s[i : i+1], true
+	}
+	if g, ok := v.(*GoObject); ok && g.goKind() == reflect.Slice {
+		return g.getElem(vm, index)
+	}
+	if obj, ok := toObject(v); ok {
+		key, ok := index.assertString()
+		if !ok {
+			vm.setError("object key must be a string, got %s", index.Type())
+			return nil, false
+		}
+		if g, ok := v.(*GoObject); ok {
+			field, ok, err := g.getGo(key)
+			if err != nil {
+				vm.setError("%s", err)
+				return nil, false
+			}
+			if ok {
+				return field, true
+			}
+		}
+		if field, ok := obj.Get(key); ok {
+			return field, true
+		}
+		return Nil{}, true
+	}
+	vm.setError("attempt to index a %s value", v.Type())
+	return nil, false
+}
+
+func setIndex(vm *VM, v Value, index Value, value Value) bool {
+	if arr, ok := v.(*Array); ok {
+		i, ok := arrayIndex(vm, *arr, index)
+		if !ok {
+			return false
+		}
+		(*arr)[i] = value
+		return true
+	}
+	if g, ok := v.(*GoObject); ok && g.goKind() == reflect.Slice {
+		if !g.setElem(vm, index, value) {
+			return false
+		}
+		vm.escape(value)
+		return true
+	}
+	if obj, ok := toObject(v); ok {
+		key, ok := index.assertString()
+		if !ok {
+			vm.setError("object key must be a string, got %s", index.Type())
+			return false
+		}
+		if g, ok := v.(*GoObject); ok {
+			ok, err := g.setGo(key, value)
+			if err != nil {
+				vm.setError("%s", err)
+				return false
 			}
+			if ok {
+				vm.escape(value)
+				return true
+			}
+		}
+		obj.Set(key, value)
+		return true
+	}
+	vm.setError("attempt to index a %s value", v.Type())
+	return false
+}
+
+// slice an array or a string, the bounds default to 0 and to the
+// length of the value when nil, slicing an array makes a new array
+func sliceValue(vm *VM, v Value, lo, hi Value) (Value, bool) {
+	var n int
+	switch s := v.(type) {
+	case *Array:
+		n = len(*s)
+	case String:
+		n = len(s)
+	default:
+		vm.setError("cannot slice a %s value", v.Type())
+		return nil, false
+	}
+
+	bounds := [2]int{0, n}
+	for i, b := range [2]Value{lo, hi} {
+		if b.Type() == ValueNil {
+			continue
+		}
+		f, ok := b.assertFloat64()
+		if !ok || !isInt(f) {
+			vm.setError("slice bounds must be integers, got %s", b.Type())
+			return nil, false
+		}
+		bounds[i] = int(f)
+	}
+	if bounds[0] < 0 || bounds[0] > bounds[1] || bounds[1] > n {
+		vm.setError("slice bounds out of range [%d:%d] with length %d", bounds[0], bounds[1], n)
+		return nil, false
+	}
+
+	if s, ok := v.(String); ok {
+		return s[bounds[0]:bounds[1]], true
+	}
+	arr := make(Array, bounds[1]-bounds[0])
+	copy(arr, (*v.(*Array))[bounds[0]:bounds[1]])
+	return &arr, true
+}
+
+// get the arguments of a call from the registers R(args) ... R(args+n-1),
+// where 'c' is the number of arguments n combined with the call flags
+func callArgs(vm *VM, cf *callFrame, args, c uint) ([]Value, map[string]Value, bool) {
+	n := c & OpCallArgsMask
+	var kwargs map[string]Value
+	if c&OpCallKwargs != 0 {
+		n--
+		kwargs = cf.r[args+n].(*Object).Fields
+	}
+
+	list := cf.r[args : args+n]
+	if c&OpCallSpread != 0 {
+		arr, ok := list[n-1].(*Array)
+		if !ok {
+			vm.setError("cannot spread a %s value", list[n-1].Type())
+			return nil, nil, false
+		}
+		list = append(list[:n-1:n-1], *arr...)
+	}
+	return list, kwargs, true
+}
+
+// call a host function, the results are stored in R(a) ... R(a+b-1),
+// 'name' is the name the script called it by, if any
+func callGoFunc(vm *VM, cf *callFrame, fn GoFunc, name string, this Value, a, b uint, args []Value, kwargs map[string]Value) int {
+	if name == "" {
+		name = builtinName(fn)
+	}
+	call := FuncCall{
+		Args:          make([]Value, len(args)),
+		KwArgs:        kwargs,
+		This:          this,
+		ExpectResults: b,
+		NumArgs:       uint(len(args)),
+		Name:          name,
+		vm:            vm,
+	}
+
+	copy(call.Args, args)
+	vm.escapeCall(fn, this, args, kwargs)
+	cf.gofn = fn
+	fn(&call)
+	if call.err != nil {
+		vm.error = vm.goFuncError(call.err)
+		cf.gofn = nil
+		return 1
+	}
+	cf.gofn = nil
+
+	for i := uint(0); i < b; i++ {
+		if int(i) >= len(call.results) {
+			cf.r[a+i] = Nil{}
 		} else {
-			// throw error
-			return 0
-		}
-	case ValueString:
-		sb, sc := vb.String(), vc.String()
-		switch op {
-		case OpLt:
-			res = sb < sc
-		case OpLe:
-			res = sb <= sc
-		case OpEq:
-			res = sb == sc
-		case OpNe:
-			res = sb != sc
-		}
-	case ValueNumber:
-		numb, _ := vb.assertFloat64()
-		numc, _ := vb.assertFloat64()
-		switch op {
-		case OpLt:
-			res = numb < numc
-		case OpLe:
-			res = numb <= numc
-		case OpEq:
-			res = numb == numc
-		case OpNe:
-			res = numb != numc
+			cf.r[a+i] = call.results[i]
 		}
 	}
-	cf.r[a] = Bool(res)
 	return 0
 }
 
-func callGoFunc(vm *VM, cf *callFrame, fn GoFunc, a, b, c uint) {
-	ab := a + b
-	ac := ab + c - 1
-	call := FuncCall{
-		Args: make([]Value, c),
-		ExpectResults: ab - a,
-		NumArgs: c,
+// get a readable name for a script function
+func funcName(proto *Bytecode) string {
+	if proto.Name == "" {
+		return "anonymous function"
 	}
+	return proto.Name
+}
+
+// get a readable name for a host function
+func goFuncName(fn GoFunc) string {
+	return goName(reflect.ValueOf(fn))
+}
 
-	for i, r := 0, ab; r <= ac; i, r = i+1, r+1 {
-		call.Args[i] = cf.r[r]
+// get a readable name for the Go function 'fn'
+func goName(fn reflect.Value) string {
+	name := runtime.FuncForPC(fn.Pointer()).Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
 	}
-	fn(&call)
+	return name
+}
 
-	nr := call.NumResults
-	if nr != call.ExpectResults {
-		nr = call.ExpectResults
+// push a new frame for a script function, the arguments are
+// copied to the registers right after 'this' (see VisitFunction)
+// and the missing ones are set to nil
+func callFunc(vm *VM, cf *callFrame, fn *Func, this Value, a, b uint, args []Value, kwargs map[string]Value) int {
+	if vm.calls.sp >= CallStackSize {
+		vm.setError("stack overflow")
+		return 1
 	}
 
-	for i := uint(0); i < nr; i++ {
-		if int(i) >= len(call.results) {
-			cf.r[a + 1] = Nil{}
+	proto := fn.Bytecode
+	numArgs := int(proto.NumArgs)
+	for key := range kwargs {
+		i := proto.argIndex(key)
+		if i < 0 {
+			vm.setError("%s got an unexpected keyword argument '%s'", funcName(proto), key)
+			return 1
+		}
+		if i < len(args) {
+			vm.setError("%s got multiple values for argument '%s'", funcName(proto), key)
+			return 1
+		}
+	}
+
+	var nf *callFrame
+	if proto.Generator {
+		// the frame runs when the generator is resumed
+		nf = &callFrame{}
+	} else {
+		nf = vm.calls.New()
+		nf.resultReg = a
+		nf.numResults = b
+	}
+	nf.fn = fn
+	nf.r[0] = this
+
+	for i := 0; i < numArgs; i++ {
+		if i < len(args) {
+			nf.r[i+1] = args[i]
+		} else {
+			nf.r[i+1] = Nil{}
+		}
+	}
+	for key, v := range kwargs {
+		nf.r[proto.argIndex(key)+1] = v
+	}
+	if proto.Variadic {
+		var extra Array
+		if len(args) > numArgs {
+			extra = append(extra, args[numArgs:]...)
 		} else {
-			cf.r[a + i] = call.results[i]
+			extra = Array{}
 		}
+		nf.r[numArgs+1] = &extra
 	}
+
+	if proto.Generator {
+		gen := &Generator{vm: vm, frame: nf}
+		nf.gen = gen
+		for i := uint(0); i < b; i++ {
+			cf.r[a+i] = Nil{}
+		}
+		if b > 0 {
+			cf.r[a] = gen
+		}
+		return 0
+	}
+	vm.currentFrame = nf
+	return 0
 }
 
-func mainLoop(vm *VM) error {
-	var currentLine uint32
-	cf := vm.currentFrame
-	proto := cf.fn.Bytecode
+// pop the frame 'cf' and store its results R(a) ... R(a+b-1)
+// in the caller's registers
+func returnFrame(vm *VM, cf *callFrame, a, b uint) int {
+	cf.closeUpvalues()
+	vm.popFrame()
+	if cf.hostResults != nil {
+		*cf.hostResults = append([]Value(nil), cf.r[a:a+b]...)
+	}
+	caller := vm.calls.Last()
+	vm.currentFrame = caller
 
-	for cf.pc < int(proto.NumCode) {
-		if currentLine+1 < proto.NumLines && (cf.pc >= int(proto.Lines[currentLine].Instr)) {
-			currentLine += 1
+	if caller != nil {
+		for i := uint(0); i < cf.numResults; i++ {
+			if i < b {
+				caller.r[cf.resultReg+i] = cf.r[a+i]
+			} else {
+				caller.r[cf.resultReg+i] = Nil{}
+			}
+		}
+		if cf.deferred {
+			return resumeDeferred(vm, caller)
 		}
+	}
+	return 0
+}
 
-		instr := proto.Code[cf.pc]
+// run the last call deferred by 'cf', a script function gets a new
+// frame and runs after the current instruction, a host function
+// runs right away
+func runDeferred(vm *VM, cf *callFrame) int {
+	n := len(cf.defers)
+	d := cf.defers[n-1]
+	cf.defers = cf.defers[:n-1]
+	switch fn := d.fn.(type) {
+	case GoFunc:
+		return callGoFunc(vm, cf, fn, "", d.this, 0, 0, d.args, d.kwargs)
+	case *Func:
+		if callFunc(vm, cf, fn, d.this, 0, 0, d.args, d.kwargs) == 1 {
+			return 1
+		}
+		if vm.currentFrame != cf {
+			vm.currentFrame.deferred = true
+		}
+	}
+	return 0
+}
+
+// continue with the frame 'cf' after one of its deferred calls returns
+func resumeDeferred(vm *VM, cf *callFrame) int {
+	if cf.panic != nil {
+		// keep unwinding, see unwind
+		vm.error = cf.panic
+		return 1
+	}
+	if !cf.recovered {
+		// a regular return, the frame is back at its OpReturn
+		return 0
+	}
+
+	// the panic was recovered, the frame returns nil values
+	// after running the remaining deferred calls
+	for len(cf.defers) > 0 {
+		if runDeferred(vm, cf) == 1 {
+			return 1
+		}
+		if vm.calls.Last() != cf {
+			return 0
+		}
+	}
+	return returnFrame(vm, cf, 0, 0)
+}
+
+// executes instructions until the frame at index 'base' returns,
+// or until the running goroutine gives way to the others
+func mainLoop(vm *VM, base int) error {
+	cf := vm.currentFrame
+	for vm.calls.sp > base {
+		instr := cf.fn.Bytecode.Code[cf.pc]
 		cf.pc++
-		cf.line = int(proto.Lines[currentLine].Line)
-		if opTable[int(instr&kOpcodeMask)](vm, cf, instr) == 1 {
+		if opTable[int(instr&kOpcodeMask)](vm, cf, instr) == 1 && !unwind(vm, base) {
 			return vm.error
 		}
+		cf = vm.currentFrame
 
-		if vm.currentFrame != cf {
-			currentLine = 0
+		// give way to the other goroutines, see schedule
+		vm.steps--
+		if vm.steps <= 0 && vm.preempt() {
+			return nil
 		}
-		cf = vm.currentFrame
-		proto = cf.fn.Bytecode
 	}
 
 	return nil
 }
+
+// unwind the call stack down to the frame at index 'base' looking
+// for a try handler for the current error, return true if one was
+// found or a deferred call must run, and the execution can continue
+func unwind(vm *VM, base int) bool {
+	err, ok := vm.error.(*RuntimeError)
+	if !ok {
+		return false
+	}
+
+	for vm.calls.sp > base {
+		cf := vm.calls.Last()
+		if len(cf.defers) > 0 && len(cf.handlers) == 0 {
+			// the deferred calls run before the frame is left, when
+			// a script function returns the unwinding continues
+			// (see resumeDeferred), unless it recovered the panic
+			cf.panic, cf.recovered = err, false
+			vm.error = nil
+			if runDeferred(vm, cf) == 1 {
+				// a new error replaces the panic
+				err = vm.error.(*RuntimeError)
+				continue
+			}
+			if vm.calls.Last() != cf {
+				return true
+			}
+			continue
+		}
+		if n := len(cf.handlers); n > 0 {
+			h := cf.handlers[n-1]
+			cf.handlers = cf.handlers[:n-1]
+			if cf.caught == nil {
+				cf.caught = make(map[uint]*RuntimeError)
+			}
+			cf.caught[h.reg] = err
+			cf.r[h.reg] = err.Value
+			cf.pc = h.pc
+			vm.currentFrame = cf
+			vm.error = nil
+			return true
+		}
+		vm.popFrame().closeUpvalues()
+	}
+
+	vm.currentFrame = vm.calls.Last()
+	vm.error = err
+	return false
+}
@@ -0,0 +1,2086 @@
+package yo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// run a script with the given globals, the values passed
+// to the builtin 'result' are returned
+func runScript(t *testing.T, source string, globals map[string]Value) ([]Value, error) {
+	var results []Value
+	vm := NewVM()
+	for name, v := range globals {
+		vm.Define(name, v)
+	}
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+
+	err := vm.RunString([]byte(source), "test")
+	return results, err
+}
+
+func TestCompareTypes(t *testing.T) {
+	arr := Array{Number(1)}
+	var closures []Value
+	for i := 0; i < 2; i++ {
+		closures = append(closures, GoFunc(func(call *FuncCall) { call.PushReturnValue(Number(i)) }))
+	}
+	values := []Value{
+		Nil{},
+		Bool(true),
+		Number(1),
+		String("a"),
+		GoFunc(func(call *FuncCall) {}),
+		// the closures of the same literal are different functions
+		closures[0],
+		closures[1],
+		&Func{Bytecode: &Bytecode{}},
+		&arr,
+		NewObject(nil, map[string]Value{"a": Number(1)}),
+		NewGoObject(nil, map[string]Value{}, nil),
+		NewVM().WrapObject(&testAddress{}),
+		make(Chan),
+		&Generator{},
+	}
+
+	for i, a := range values {
+		for j, b := range values {
+			globals := map[string]Value{"a": a, "b": b}
+			results, err := runScript(t, "result(a == b, a != b)", globals)
+			if err != nil {
+				t.Fatalf("%s == %s: %s", a.Type(), b.Type(), err)
+			}
+			same := i == j
+			if results[0] != Bool(same) || results[1] != Bool(!same) {
+				t.Errorf("(%d, %d) %s == %s: got %v, %v", i, j, a.Type(), b.Type(), results[0], results[1])
+			}
+
+			ordered := a.Type() == b.Type() && (a.Type() == ValueNumber || a.Type() == ValueString)
+			for _, op := range []string{"<", "<=", ">", ">="} {
+				_, err := runScript(t, "result(a "+op+" b)", globals)
+				if ordered && err != nil {
+					t.Errorf("%s %s %s: %s", a.Type(), op, b.Type(), err)
+				} else if !ordered && err == nil {
+					t.Errorf("%s %s %s: expected an error", a.Type(), op, b.Type())
+				}
+			}
+		}
+	}
+}
+
+func TestCompareOrder(t *testing.T) {
+	source := `
+	one, two := 1, 2
+	result(one < two, one <= two, one > two, one >= two)
+	result(two < one, two <= one, two > one, two >= one)
+	result(one < one, one <= one, one > one, one >= one)
+	a, b := "a", "b"
+	result(a < b, a <= b, a > b, a >= b)
+	`
+	expected := []bool{
+		true, true, false, false,
+		false, false, true, true,
+		false, true, false, true,
+		true, true, false, false,
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if res != Bool(expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestCompareDeepEqual(t *testing.T) {
+	source := `
+	result([1, [2, "x"]] == [1, [2, "x"]], [1, 2] == [1, 2, 3], [1, 2] != [2, 1])
+	result({a: 1, b: [2]} == {b: [2], a: 1}, {a: 1} == {a: 2}, {a: 1} == {b: 1})
+	p := {x: 1}
+	result(new(p) == new(p), new(p) == {}, p == p)
+	f := func() {}
+	result(f == f, f == func() {})
+	`
+	expected := []bool{
+		true, false, true,
+		true, false, false,
+		true, false, true,
+		true, false,
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if res != Bool(expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestCompareCycles(t *testing.T) {
+	a, b := Array{Nil{}}, Array{Nil{}}
+	a[0], b[0] = &a, &b
+	if !valuesEqual(&a, &b) {
+		t.Error("expected cyclic arrays to be equal")
+	}
+
+	o1 := NewObject(nil, map[string]Value{"n": Number(1)})
+	o2 := NewObject(nil, map[string]Value{"n": Number(1)})
+	o1.Set("self", o1)
+	o2.Set("self", o2)
+	if !valuesEqual(o1, o2) {
+		t.Error("expected cyclic objects to be equal")
+	}
+	o2.Set("n", Number(2))
+	if valuesEqual(o1, o2) {
+		t.Error("expected cyclic objects with different fields to differ")
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	source := `
+	n, obj := nil, {enabled: true}
+	result(n && n.enabled, obj && obj.enabled, n || "default", 0 && "zero")
+	result(1 && 2 && 3, nil || false || "last", n && n.x || "fallback")
+	x, y := 5, nil
+	x = y && x
+	result(x)
+	x = 3
+	x = y || x
+	result(x)
+	if n && n.enabled {
+		result("unreachable")
+	}
+	result(true && "const", false || 7, nil && 1)
+	`
+	expected := []Value{
+		Nil{}, Bool(true), String("default"), String("zero"),
+		Number(3), String("last"), String("fallback"),
+		Nil{},
+		Number(3),
+		String("const"), Number(7), Nil{},
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestLogicalShortCircuit(t *testing.T) {
+	tests := []struct {
+		source string
+		calls  int
+	}{
+		{"result(false && side(1))", 0},
+		{"result(nil && side(1))", 0},
+		{"result(true && side(1))", 1},
+		{"result(true || side(1))", 0},
+		{"result(nil || side(1))", 1},
+		{"result(side(nil) && side(1))", 1},
+		{"result(side(1) && side(2))", 2},
+		{"result(side(1) || side(2))", 1},
+		{"result(side(nil) || side(false) || side(3))", 3},
+		{"if side(false) && side(true) { }", 1},
+		{"x := side(1) || side(2)", 1},
+		{"result(side(nil) && side(1), side(1) || side(2))", 2},
+	}
+
+	for _, test := range tests {
+		var calls int
+		side := GoFunc(func(call *FuncCall) {
+			calls++
+			call.PushReturnValue(call.Args[0])
+		})
+		if _, err := runScript(t, test.source, map[string]Value{"side": side}); err != nil {
+			t.Errorf("%s: %s", test.source, err)
+			continue
+		}
+		if calls != test.calls {
+			t.Errorf("%s: expected %d calls, got %d", test.source, test.calls, calls)
+		}
+	}
+}
+
+func TestIntegerArith(t *testing.T) {
+	source := `
+	a, b, zero := 7, -7, 0
+	result(a % 3, b % 3, a % -3, 7.5 % 2)
+	result(a ~/ 2, b ~/ 2, 7.5 ~/ 2)
+	result(b & 255, b | 1, b ^ 1, b >> 1, 1 << 40, ^b)
+	`
+	expected := []Value{
+		Number(1), Number(-1), Number(1), Number(1.5),
+		Number(3), Number(-3), Number(3),
+		Number(249), Number(-7), Number(-8), Number(-4), Number(1 << 40), Number(6),
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	for _, source := range []string{"a := 0; result(1 % a)", "a := 0; result(1 ~/ a)", "a := 1.5; result(a & 1)", "a := -1; result(1 << a)"} {
+		if _, err := runScript(t, source, nil); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestStringOps(t *testing.T) {
+	source := `
+	name := "world"
+	s := "Hello, " + name
+	result(s, len(s), s[0], s[7:], s[:5], s[7:9])
+	arr := [1, 2, 3, 4]
+	b := append(arr[1:3], 9)
+	result(b, arr, len(arr[:0]))
+	`
+	expected := []Value{
+		String("Hello, world"), Number(12), String("H"), String("world"), String("Hello"), String("wo"),
+		&Array{Number(2), Number(3), Number(9)}, &Array{Number(1), Number(2), Number(3), Number(4)}, Number(0),
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	for _, source := range []string{`"a"[1]`, `[1][1:0]`, `"a" + 1`, `len(1)`} {
+		if _, err := runScript(t, source, nil); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	source := `
+	func swap(a, b) {
+		return b, a
+	}
+	func none() {}
+	func apply(f, x) {
+		return f(x)
+	}
+	func double(x) {
+		return x * 2
+	}
+	func args(a, b) {
+		return a, b
+	}
+	x, y := swap(1, 2)
+	result(x, y, none())
+	a, b := args(1)
+	result(a, b)
+	a, b = args(1, 2, 3)
+	result(a, b, apply(double, 21))
+	`
+	expected := []Value{
+		Number(2), Number(1), Nil{},
+		Number(1), Nil{},
+		Number(1), Number(2), Number(42),
+	}
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if res != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	_, err = runScript(t, "x := 1; x()", nil)
+	if err == nil || !strings.Contains(err.Error(), "attempt to call a number value") {
+		t.Errorf("expected a call error, got %v", err)
+	}
+}
+
+func TestCallArgs(t *testing.T) {
+	source := `
+	func greet(name, greeting="Hello", punct="!") -> greeting + ", " + name + punct
+	result(greet("a"), greet("b", "Hi"), greet("c", punct="?"), greet(greeting="Yo", name="d"))
+
+	func sum(first, rest...) {
+		for x in rest {
+			first = first + x
+		}
+		return first
+	}
+	nums := [4, 5, 6]
+	result(sum(1), sum(1, 2, 3), sum(nums...), sum(1, nums...))
+
+	x, y := nums...
+	result(x, y)
+
+	result(host(1, 2, scale=10))
+	`
+	expected := []Value{
+		String("Hello, a!"), String("Hi, b!"), String("Hello, c?"), String("Yo, d!"),
+		Number(1), Number(6), Number(15), Number(16),
+		Number(4), Number(5),
+		Number(30),
+	}
+
+	host := GoFunc(func(call *FuncCall) {
+		scale := call.KwArgs["scale"].(Number)
+		call.PushReturnValue((call.Args[0].(Number) + call.Args[1].(Number)) * scale)
+	})
+	results, err := runScript(t, source, map[string]Value{"host": host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	for _, source := range []string{
+		"func f(a) {}; f(b=1)",
+		"func f(a) {}; f(1, a=1)",
+		"func f(a) {}; n := 1; f(n...)",
+	} {
+		if _, err := runScript(t, source, nil); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+
+	// the unpacking errors are at the line of the values
+	for _, source := range []string{
+		"a := 1\nc, d := [1]...\nx := 2",
+		"a := 1\nc, d := [\n\t1,\n]...\nx := 2",
+	} {
+		_, err := runScript(t, source, nil)
+		if rerr, ok := err.(*RuntimeError); !ok || rerr.Line != 2 {
+			t.Errorf("%q: expected an error at line 2, got %v", source, err)
+		}
+	}
+}
+
+func TestIndexing(t *testing.T) {
+	source := `
+	obj := {a: 1, b: {c: [1, {d: 2}]}}
+	result(obj.a, obj["a"], obj.b.c[1].d)
+	obj.a = 10
+	obj["x"] = 5
+	obj.b.c[1].d = 20
+	k := "c"
+	obj.b[k][0] = 30
+	result(obj.a, obj.x, obj.b.c[1].d, obj.b.c[0], obj.missing)
+	arr := [1, 2]
+	arr[1] = 3
+	result(arr[1])
+	child.own = 2
+	result(child.inherited, child["own"], proto.own)
+	`
+	expected := []Value{
+		Number(1), Number(1), Number(2),
+		Number(10), Number(5), Number(20), Number(30), Nil{},
+		Number(3),
+		Number(1), Number(2), Nil{},
+	}
+	proto := NewObject(nil, map[string]Value{"inherited": Number(1)})
+	child := NewObject(proto, map[string]Value{})
+	results, err := runScript(t, source, map[string]Value{"proto": proto, "child": child})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if res != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	errors := []struct {
+		source string
+		msg    string
+	}{
+		{"x := [1]; x[5]", "array index 5 out of range [0:1]"},
+		{"x := [1]; x[1] = 2", "array index 1 out of range [0:1]"},
+		{"x := [1]; x[-1]", "array index -1 out of range [0:1]"},
+		{`x := [1]; x["a"]`, "array index must be an integer, got string"},
+		{"x := {}; x[1]", "object key must be a string, got number"},
+		{"x := 1; x.y", "attempt to index a number value"},
+		{"x := 1; x.y = 2", "attempt to index a number value"},
+	}
+	for _, e := range errors {
+		_, err := runScript(t, e.source, nil)
+		if err == nil || !strings.Contains(err.Error(), e.msg) {
+			t.Errorf("%s: expected error %q, got %v", e.source, e.msg, err)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	source := `
+	Vector := {x: 1, y: 2}
+	func Vector.scale(k) {
+		return {x: this.x * k, y: this.y * k}
+	}
+	w := Vector.scale(3)
+	result(w.x, w.y)
+
+	func Base.sum() {
+		return this.x + this.y
+	}
+	result(child.sum())
+
+	counter := {n: 0, inc: func() {
+		this.n = this.n + 1
+		return this
+	}}
+	counter.inc().inc()
+	result(counter.n)
+
+	f := func() {
+		return this
+	}
+	result(f(), host.describe("x"))
+	`
+	expected := []Value{
+		Number(3), Number(6),
+		Number(11),
+		Number(2),
+		Nil{}, String("host x"),
+	}
+
+	base := NewObject(nil, map[string]Value{})
+	child := NewObject(base, map[string]Value{"x": Number(5), "y": Number(6)})
+	host := NewGoObject(nil, map[string]Value{
+		"describe": GoFunc(func(call *FuncCall) {
+			this := call.This.(*GoObject)
+			call.PushReturnValue(String(this.Data.(string) + " " + string(call.Args[0].(String))))
+		}),
+	}, "host")
+	results, err := runScript(t, source, map[string]Value{"Base": base, "child": child, "host": host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if res != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	_, err = runScript(t, "x := {}; x.missing()", nil)
+	if err == nil || !strings.Contains(err.Error(), "attempt to call a nil value as a method of object") {
+		t.Errorf("expected a method call error, got %v", err)
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	source := `
+	func seq(start) {
+		i := 0
+		return func() -> start + i++
+	}
+	next := seq(10)
+	result(next(), next(), next())
+	x := 5
+	y := x++
+	result(x, y, x--, x)
+	obj, arr, i := {count: 1}, [1, 2, 3], 0
+	obj.count++
+	obj.count += 5
+	arr[i++] += 10
+	result(obj.count, arr[0], i)
+	side(obj).count -= 2
+	side(arr)[0]--
+	result(obj.count, arr[0])
+	s, b := "a", 6
+	s += "bc"
+	b |= 1
+	b ^= 2
+	b &= 5
+	result(s, b)
+	o, n := {a: 3}, 17
+	o.a <<= 2
+	b >>= 1
+	n %= 5
+	arr[1] ~/= 2
+	result(o.a, b, n, arr[1], 1 << 3, 9 >> 1, 7 ~/ 2)
+	`
+	expected := []Value{
+		Number(10), Number(11), Number(12),
+		Number(6), Number(5), Number(6), Number(5),
+		Number(7), Number(11), Number(1),
+		Number(5), Number(10),
+		String("abc"), Number(5),
+		Number(12), Number(2), Number(2), Number(1), Number(8), Number(4), Number(3),
+	}
+
+	var calls int
+	side := GoFunc(func(call *FuncCall) {
+		calls++
+		call.PushReturnValue(call.Args[0])
+	})
+	results, err := runScript(t, source, map[string]Value{"side": side})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected the targets to be evaluated once, got %d calls", calls)
+	}
+}
+
+func TestPrefixIncrement(t *testing.T) {
+	source := `
+	g := 1
+	++g
+	y := ++g
+	obj, arr := {count: 1}, [1, 2]
+	++obj.count
+	z := --obj.count
+	++arr[0]
+	w := --arr[1]
+	func local() {
+		l := 1
+		++l
+		return l, ++l
+	}
+	func counter() {
+		x := 1
+		return func() {
+			++x
+			return x
+		}
+	}
+	inc := counter()
+	l, m := local()
+	result(g, y, obj.count, z, arr[0], arr[1], w, l, m, inc(), inc())
+	`
+	expected := []Value{
+		Number(3), Number(3), Number(1), Number(1), Number(2), Number(1), Number(1),
+		Number(2), Number(3), Number(2), Number(3),
+	}
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	source := `
+	func block() {
+		var f
+		if true {
+			x := 1
+			f = func() { return x }
+		}
+		y := 99
+		return f()
+	}
+	func loop() {
+		fns := []
+		for i := 0; i < 3; i++ {
+			fns = append(fns, func() { return i })
+		}
+		return fns
+	}
+	func iterator() {
+		fns := []
+		for k, v in {a: 1, b: 2, c: 3} {
+			if k == "b" {
+				continue
+			}
+			fns = append(fns, func() { return v })
+		}
+		for i := 0; i < 5; i++ {
+			x := i * 10
+			fns = append(fns, func() { return x })
+			if i == 1 {
+				break
+			}
+		}
+		return fns
+	}
+	func shared() {
+		n := 0
+		inc := func() { n += 1 }
+		get := func() { return n }
+		inc()
+		inc()
+		return get
+	}
+	func caught() {
+		var f
+		try {
+			x := "try"
+			f = func() { return x }
+			panic("oops")
+		} recover e {
+			y := "recover"
+		}
+		return f()
+	}
+	l := loop()
+	it := iterator()
+	result(block(), l[0](), l[1](), l[2](), it[0](), it[1](), it[2](), it[3](), shared()(), caught())
+	`
+	expected := []Value{
+		Number(1), Number(0), Number(1), Number(2), Number(1), Number(3), Number(0), Number(10),
+		Number(2), String("try"),
+	}
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestPrototypes(t *testing.T) {
+	source := `
+	base := {greet: "hi", kind: "base"}
+	obj := setproto({kind: "obj"}, base)
+	result(obj.greet, obj.kind, getproto(obj).kind, hasOwn(obj, "kind"), hasOwn(obj, "greet"))
+	base.greet = "hello"
+	result(obj.greet)
+	obj.greet = "own"
+	result(obj.greet, base.greet, hasOwn(obj, "greet"))
+	child := setproto({}, obj)
+	result(child.kind, child.greet)
+	result(setproto(obj, nil).kind, getproto(obj), obj.kind, obj.missing, child.kind, getproto({}))
+	`
+	expected := []Value{
+		String("hi"), String("obj"), String("base"), Bool(true), Bool(false),
+		String("hello"),
+		String("own"), String("hello"), Bool(true),
+		String("obj"), String("own"),
+		String("obj"), Nil{}, String("obj"), Nil{}, String("obj"), Nil{},
+	}
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if res != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	errors := []struct {
+		source string
+		msg    string
+	}{
+		{"a := {}; setproto(a, a)", "setproto would create a prototype cycle"},
+		{"a := {}; b := setproto({}, a); setproto(a, b)", "setproto would create a prototype cycle"},
+		{"setproto({}, 1)", "setproto: argument 2: expected an object, got number"},
+		{"setproto({})", "setproto: expected at least 2 arguments, got 1"},
+		{"getproto(1)", "getproto: argument 1: expected an object, got number"},
+		{"hasOwn({}, 1)", "hasOwn: argument 2: expected a string, got number"},
+	}
+	for _, e := range errors {
+		_, err := runScript(t, e.source, nil)
+		if err == nil || !strings.Contains(err.Error(), e.msg) {
+			t.Errorf("%s: expected error %q, got %v", e.source, e.msg, err)
+		}
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	source := `
+	count := 0
+	func inc() { count++ }
+	inc()
+	inc()
+	const limit = 3
+	first, second := "a", "b"
+	host += 1
+	if true {
+		local := 1
+	}
+	func fib(n) -> n < 2 ? n : fib(n-1) + fib(n-2)
+	result(fib(10))
+	`
+	vm := NewVM()
+	vm.Define("host", Number(41))
+	vm.Define("result", GoFunc(func(call *FuncCall) {}))
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]Value{
+		"count":  Number(2),
+		"limit":  Number(3),
+		"first":  String("a"),
+		"second": String("b"),
+		"host":   Number(42),
+	}
+	for name, value := range expected {
+		if !valuesEqual(vm.Globals[name], value) {
+			t.Errorf("global %s: expected %v, got %v", name, value, vm.Globals[name])
+		}
+	}
+	if _, ok := vm.Globals["fib"].(*Func); !ok {
+		t.Errorf("global fib: expected a function, got %v", vm.Globals["fib"])
+	}
+	if _, ok := vm.Globals["local"]; ok {
+		t.Error("expected block-scoped variable not to be a global")
+	}
+
+	_, err := runScript(t, "x := 1\nresult(x + missing)", nil)
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected an error naming the undefined global, got %v", err)
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	source := `
+	func classify(x) {
+		switch x {
+		case 1, 2:
+			return "small"
+		case 3:
+			fallthrough
+		case 4:
+			return "medium"
+		case "str":
+			return "string"
+		default:
+			return "other"
+		}
+	}
+	result(classify(1), classify(3), classify(4), classify("str"), classify("1"), classify(9))
+
+	func grade(n) {
+		switch {
+		case n >= 90:
+			return "A"
+		case n >= 80:
+			return "B"
+		}
+		return "F"
+	}
+	result(grade(95), grade(85), grade(10))
+
+	func kind(v) {
+		switch type(v) {
+		case number, string:
+			return "scalar"
+		case nil:
+			return "nothing"
+		case func:
+			return "callable"
+		default:
+			return "container"
+		}
+	}
+	result(kind(1), kind("a"), kind(nil), kind(kind), kind([]))
+
+	limit := 5
+	switch n := 6; n {
+	case limit:
+		result("limit")
+	case limit + 1:
+		result("after limit")
+	}
+
+	total := 0
+	for i := 0; i < 6; i++ {
+		switch i {
+		case 1:
+			continue
+		case 4:
+			break
+		default:
+			total += i
+		}
+		total += 100
+	}
+	result(total)
+	`
+	expected := []Value{
+		String("small"), String("medium"), String("medium"), String("string"), String("other"), String("other"),
+		String("A"), String("B"), String("F"),
+		String("scalar"), String("scalar"), String("nothing"), String("callable"), String("container"),
+		String("after limit"),
+		Number(510),
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	for _, source := range []string{
+		"fallthrough",
+		"switch 1 { case 1: fallthrough }",
+		"switch 1 { case 1: if true { fallthrough } case 2: }",
+		"switch 1 { case 1, 1: }",
+		"switch 1 { default: default: }",
+		"break",
+	} {
+		if _, err := runScript(t, source, nil); err == nil {
+			t.Errorf("%s: expected an error", source)
+		}
+	}
+}
+
+func TestForIterator(t *testing.T) {
+	source := `
+	for k, v in {c: 3, a: 1, b: 2} {
+		result(k, v)
+	}
+	for v in {z: 1, y: 2} {
+		result(v)
+	}
+	for i, r in "aé日b" {
+		result(i, r)
+	}
+	for v in [10, nil, 30, false, 50] when v {
+		result(v)
+	}
+	for k, v in {a: {keep: true}, b: {}, c: {keep: true}} when v.keep {
+		result(k)
+	}
+	`
+	expected := []Value{
+		String("a"), Number(1), String("b"), Number(2), String("c"), Number(3),
+		Number(2), Number(1),
+		Number(0), String("a"), Number(1), String("é"), Number(3), String("日"), Number(6), String("b"),
+		Number(10), Number(30), Number(50),
+		String("a"), String("c"),
+	}
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if res != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestTryFinally(t *testing.T) {
+	source := `
+	func normal() {
+		try {
+			result("try")
+		} recover e {
+			result("not recovered")
+		} finally {
+			result("finally")
+		}
+		return "after"
+	}
+	func returning() {
+		try {
+			return "from try"
+		} finally {
+			result("finally after return")
+		}
+		return "not reached"
+	}
+	func rethrow() {
+		try {
+			panic("first")
+		} recover e {
+			panic("again")
+		} finally {
+			result("finally after rethrow")
+		}
+	}
+	func nested() {
+		try {
+			try {
+				panic("inner")
+			} finally {
+				result("inner finally")
+			}
+		} recover e {
+			result(e)
+		} finally {
+			result("outer finally")
+		}
+	}
+	func loop() {
+		n := 0
+		for step in [{}, {skip: true}, {}, {stop: true}, {}] {
+			try {
+				if step.skip {
+					continue
+				}
+				if step.stop {
+					break
+				}
+			} finally {
+				n = n + 10
+			}
+		}
+		return n
+	}
+	result(normal())
+	result(returning())
+	try {
+		rethrow()
+	} recover e {
+		result(e)
+	}
+	nested()
+	result(loop())
+	`
+	expected := []Value{
+		String("try"), String("finally"), String("after"),
+		String("finally after return"), String("from try"),
+		String("finally after rethrow"), String("again"),
+		String("inner finally"), String("inner"), String("outer finally"),
+		Number(40),
+	}
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if res != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestDefer(t *testing.T) {
+	source := `
+	func order() {
+		for i := 0; i < 3; i++ {
+			defer result(i)
+		}
+		result("body")
+		return "ret"
+	}
+	result(order())
+
+	func safe() {
+		defer func() {
+			result("recovered " + recover())
+		}()
+		defer result("before recover")
+		panic("boom")
+	}
+	result(safe())
+
+	func failing() {
+		defer result("deferred")
+		x := nil
+		return x.field
+	}
+	try {
+		failing()
+	} recover e {
+		result("caught")
+	}
+
+	func replaced() {
+		defer func() { result(recover()) }()
+		defer func() { panic("second") }()
+		panic("first")
+	}
+	replaced()
+
+	counter := {n: 0, add: func(k) { this.n += k }}
+	func method() {
+		defer counter.add(10)
+		counter.n = 1
+	}
+	method()
+	result(counter.n, recover())
+	`
+	expected := []Value{
+		String("body"), Number(2), Number(1), Number(0), String("ret"),
+		String("before recover"), String("recovered boom"), Nil{},
+		String("deferred"), String("caught"),
+		String("second"),
+		Number(11), Nil{},
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d: %v", len(expected), len(results), results)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	results, err = runScript(t, `defer result("cleanup"); x := nil; x()`, nil)
+	if err == nil {
+		t.Error("expected the error to reach the host")
+	}
+	if len(results) != 1 || results[0] != String("cleanup") {
+		t.Errorf("expected the deferred call to run on a runtime error, got %v", results)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	source := `
+	squares := make(chan)
+	go func(n) {
+		for i := 1; i <= n; i++ {
+			squares <- i * i
+		}
+		close(squares)
+	}(4)
+	sum := 0
+	for v in squares {
+		sum += v
+	}
+	result(sum)
+	v, ok := <-squares
+	result(v, ok)
+
+	buffered := make(chan, 2)
+	buffered <- "a"
+	result(len(buffered))
+
+	empty := make(chan, 1)
+	select {
+	case x := <-empty:
+		result("empty", x)
+	case x, ok := <-buffered:
+		result(x, ok)
+	}
+	select {
+	case empty <- 1:
+		result("sent")
+	default:
+		result("default")
+	}
+	select {
+	case empty <- 2:
+		result("sent")
+	default:
+		result("full")
+	}
+	var got
+	select {
+	case got = <-empty:
+	}
+	result(got)
+	`
+	expected := []Value{
+		Number(30),
+		Nil{}, Bool(false),
+		Number(1),
+		String("a"), Bool(true),
+		String("sent"),
+		String("full"),
+		Number(1),
+	}
+
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d: %v", len(expected), len(results), results)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	errors := []struct {
+		source string
+		msg    string
+	}{
+		{"ch := make(chan); close(ch); ch <- 1", "send on closed channel"},
+		{"ch := make(chan); close(ch); close(ch)", "close of closed channel"},
+		{"x := 1; x <- 1", "cannot send to a number value"},
+		{"x := 1; <-x", "cannot receive from a number value"},
+		{"make(chan, -1)", "channel size must be a non-negative integer"},
+	}
+	for _, e := range errors {
+		_, err := runScript(t, e.source, nil)
+		if err == nil || !strings.Contains(err.Error(), e.msg) {
+			t.Errorf("%s: expected error %q, got %v", e.source, e.msg, err)
+		}
+	}
+}
+
+func TestGoroutines(t *testing.T) {
+	// the goroutines share the globals and the captured variables
+	source := `
+	counter := 0
+	done := make(chan)
+	for i := 0; i < 10; i++ {
+		go func() {
+			counter++
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	result(counter)
+
+	blocked := make(chan)
+	go func() { <-blocked }()
+	`
+	results, err := runScript(t, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != Number(10) {
+		t.Errorf("expected [10], got %v", results)
+	}
+
+	// a failing goroutine stops the script
+	_, err = runScript(t, `ch := make(chan); go func() { panic("boom") }(); <-ch`, nil)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("expected the goroutine's error, got %v", err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	// the order of the goroutines depends only on the seed
+	source := `
+	done := make(chan)
+	for i := 0; i < 4; i++ {
+		go func(i) {
+			for j := 0; j < 3; j++ {
+				result(i)
+				sleep(0)
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	`
+	run := func(seed int64) []Value {
+		var results []Value
+		vm := NewVM()
+		vm.Seed(seed)
+		vm.Define("result", GoFunc(func(call *FuncCall) {
+			results = append(results, call.Args...)
+		}))
+		if err := vm.RunString([]byte(source), "test"); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	first := run(42)
+	if len(first) != 12 {
+		t.Fatalf("expected 12 results, got %v", first)
+	}
+	for i := 0; i < 3; i++ {
+		again := run(42)
+		for j := range first {
+			if again[j] != first[j] {
+				t.Fatalf("expected the same order for the same seed, got %v and %v", first, again)
+			}
+		}
+	}
+
+	// a goroutine which never waits gives way to the others after its quantum
+	_, err := runScript(t, `
+	stop := false
+	go func() { for !stop {} }()
+	sleep(0.01)
+	stop = true
+	`, nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = runScript(t, `select {}`, nil)
+	if err == nil || !strings.Contains(err.Error(), "deadlock") {
+		t.Errorf("expected a deadlock error, got %v", err)
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	deadlocks := []string{
+		`ch := make(chan); <-ch`,
+		`ch := make(chan, 1); ch <- 1; ch <- 2`,
+		`ch := make(chan); go func() { ch <- 1 }(); <-ch; <-ch`,
+		`a, b := make(chan), make(chan); go func() { <-a; b <- 1 }(); <-b`,
+		`ch := make(chan); select { case <-ch: case ch <- 1: }`,
+		`ch := make(chan); call(func() { <-ch })`,
+	}
+	for _, source := range deadlocks {
+		vm := NewVM()
+		vm.Define("call", GoFunc(func(call *FuncCall) {
+			if _, err := vm.Call(call.Args[0]); err != nil {
+				call.Error("%s", err.(*RuntimeError).Message)
+			}
+		}))
+		err := vm.RunString([]byte(source), "test")
+		if _, ok := err.(*RuntimeError); !ok || !strings.Contains(err.Error(), "all goroutines are asleep - deadlock!") {
+			t.Errorf("%s: expected a deadlock error, got %v", source, err)
+		}
+	}
+
+	// the channels given to the host may be used by it later
+	feed := GoFunc(func(call *FuncCall) {
+		ch := call.Args[0].(Chan)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			ch <- Number(1)
+		}()
+	})
+	feedObject := GoFunc(func(call *FuncCall) {
+		v, _ := call.Args[0].(*Object).Get("ch")
+		ch := v.(Chan)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			ch <- Number(2)
+		}()
+	})
+	source := `
+	ch := make(chan)
+	feed(ch)
+	result(<-ch)
+	other := make(chan)
+	feedObject({ch: other})
+	result(<-other)
+	done := make(chan)
+	go func() {
+		sleep(0.01)
+		done <- 3
+	}()
+	result(<-done)
+	`
+	expected := []Value{Number(1), Number(2), Number(3)}
+	results, err := runScript(t, source, map[string]Value{"feed": feed, "feedObject": feedObject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	source := `
+	func naturals() {
+		n := 0
+		for {
+			yield n
+			n++
+		}
+	}
+	func take(gen, k) {
+		for i, v in gen {
+			if i >= k {
+				return
+			}
+			yield v
+		}
+	}
+	for i, v in take(naturals(), 3) {
+		result(i, v)
+	}
+
+	func fromChan(ch) {
+		defer result("closed")
+		for v in ch {
+			yield v * 2
+		}
+	}
+	ch := make(chan)
+	go func() {
+		ch <- 1
+		ch <- 2
+		close(ch)
+	}()
+	for v in fromChan(ch) {
+		result(v)
+	}
+
+	func failing() {
+		yield 1
+		panic("boom")
+	}
+	gen := failing()
+	try {
+		for v in gen {
+			result(v)
+		}
+	} recover e {
+		result(e)
+	}
+	for v in gen {
+		result("finished generators yield nothing")
+	}
+	result(type(gen))
+
+	squares := func(n) {
+		for i := 1; i <= n; i++ {
+			yield i * i
+		}
+	}(3)
+	`
+	expected := []Value{
+		Number(0), Number(0), Number(1), Number(1), Number(2), Number(2),
+		Number(2), Number(4), String("closed"),
+		Number(1), String("boom"),
+		String("generator"),
+	}
+
+	vm := NewVM()
+	var results []Value
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %d: %v", len(expected), len(results), results)
+	}
+	for i, res := range results {
+		if !valuesEqual(res, expected[i]) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	// the host drives the generator
+	squares := vm.Globals["squares"].(*Generator)
+	for _, n := range []Number{1, 4, 9} {
+		v, ok, err := squares.Next()
+		if err != nil || !ok || v != n {
+			t.Errorf("expected %v, got %v, %v, %v", n, v, ok, err)
+		}
+	}
+	if v, ok, err := squares.Next(); ok || err != nil {
+		t.Errorf("expected the generator to finish, got %v, %v, %v", v, ok, err)
+	}
+
+	_, err := runScript(t, "yield 1", nil)
+	if err == nil || !strings.Contains(err.Error(), "yield outside function") {
+		t.Errorf("expected a compile error, got %v", err)
+	}
+}
+
+func TestRuntimeError(t *testing.T) {
+	vm := NewVM()
+	err := vm.RunString([]byte(`
+	func inner(x) {
+		return x.y.z
+	}
+	func outer() {
+		return inner({})
+	}
+	outer()
+	`), "trace.yo")
+	rerr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected a *RuntimeError, got %v", err)
+	}
+	if rerr.Message != "attempt to index a nil value" || rerr.File != "trace.yo" || rerr.Line != 3 {
+		t.Errorf("expected the error at trace.yo:3, got %q at %s:%d", rerr.Message, rerr.File, rerr.Line)
+	}
+	expected := []StackEntry{
+		{Func: "inner", File: "trace.yo", Line: 3},
+		{Func: "outer", File: "trace.yo", Line: 6},
+		{Func: "main", File: "trace.yo", Line: 8},
+	}
+	if len(rerr.Traceback) != len(expected) {
+		t.Fatalf("expected traceback %v, got %v", expected, rerr.Traceback)
+	}
+	for i, entry := range rerr.Traceback {
+		if entry != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], entry)
+		}
+	}
+
+	// the host functions have entries of their own, without a location
+	vm = NewVM()
+	err = vm.RunString([]byte(`
+	func proto(x) {
+		return getproto(x)
+	}
+	proto(1)
+	`), "go.yo")
+	rerr, ok = err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("expected a *RuntimeError, got %v", err)
+	}
+	if rerr.File != "go.yo" || rerr.Line != 3 {
+		t.Errorf("expected the error at go.yo:3, got %s:%d", rerr.File, rerr.Line)
+	}
+	expected = []StackEntry{
+		{Func: "yo.builtinGetProto", IsGo: true},
+		{Func: "proto", File: "go.yo", Line: 3},
+		{Func: "main", File: "go.yo", Line: 5},
+	}
+	if len(rerr.Traceback) != len(expected) {
+		t.Fatalf("expected traceback %v, got %v", expected, rerr.Traceback)
+	}
+	for i, entry := range rerr.Traceback {
+		if entry != expected[i] {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], entry)
+		}
+	}
+	if msg := err.Error(); !strings.Contains(msg, "\n\t[Go]: in yo.builtinGetProto\n\tgo.yo:3: in proto") {
+		t.Errorf("expected the traceback in the message, got %q", msg)
+	}
+
+	// the failing operand may be the last token of its line
+	lines := []struct {
+		source string
+		line   int
+	}{
+		{"x := 1\ny := undefinedName\nz := 2", 2},
+		{"ch := make(chan)\n<-ch\nx := 1", 2},
+		{"o := {}\nx := o.a.b\n", 2},
+		{"x := {}\ny := 1 + x\n", 2},
+	}
+	for _, l := range lines {
+		err := NewVM().RunString([]byte(l.source), "line.yo")
+		rerr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Errorf("%q: expected a *RuntimeError, got %v", l.source, err)
+			continue
+		}
+		if rerr.Line != l.line {
+			t.Errorf("%q: expected the error at line %d, got %d", l.source, l.line, rerr.Line)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	vm := NewVM()
+	var results []Value
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+	// calls back into the script from a host function
+	vm.Define("apply", GoFunc(func(call *FuncCall) {
+		res, err := vm.Call(call.Args[0], call.Args[1:]...)
+		if err != nil {
+			call.Error("%w", err)
+			return
+		}
+		for _, v := range res {
+			call.PushReturnValue(v)
+		}
+	}))
+
+	source := `
+	func sumdiff(a, b) {
+		return a + b, a - b
+	}
+	func fail(msg) {
+		panic(msg)
+	}
+	func counter() {
+		for i := 1; i <= 3; i++ {
+			yield i
+		}
+	}
+	s, d := apply(sumdiff, 7, 2)
+	result(s, d)
+	s, d = apply(apply, sumdiff, 9, 4)
+	result(s, d)
+	try {
+		apply(fail, "inner")
+	} recover e {
+		result("recovered", e)
+	}
+	`
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Value{Number(9), Number(5), Number(13), Number(5), String("recovered"), String("inner")}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(expected[i], res) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	// the host calls the script after it ran
+	res, err := vm.CallGlobal("sumdiff", Number(11), Number(4))
+	if err != nil || len(res) != 2 || res[0] != Number(15) || res[1] != Number(7) {
+		t.Errorf("expected [15 7], got %v, %v", res, err)
+	}
+	res, err = vm.CallGlobal("fail", String("boom"))
+	if _, ok := err.(*RuntimeError); !ok || !strings.Contains(err.Error(), "boom") || res != nil {
+		t.Errorf("expected a runtime error, got %v, %v", res, err)
+	}
+	// the error of the nested call isn't wrapped again
+	_, err = vm.CallGlobal("apply", vm.Globals["fail"], String("nested"))
+	rerr, ok := err.(*RuntimeError)
+	if !ok || rerr.Message != "nested" || rerr.Line != 6 || strings.Count(err.Error(), "test:6") != 2 {
+		t.Errorf("expected the error of the nested call, got %v", err)
+	}
+	res, err = vm.CallGlobal("counter")
+	if err != nil || len(res) != 1 {
+		t.Fatalf("expected a generator, got %v, %v", res, err)
+	}
+	if v, ok, err := res[0].(*Generator).Next(); v != Number(1) || !ok || err != nil {
+		t.Errorf("expected 1, got %v, %v, %v", v, ok, err)
+	}
+	res, err = vm.CallGlobal("len", String("abc"))
+	if err != nil || len(res) != 1 || res[0] != Number(3) {
+		t.Errorf("expected [3], got %v, %v", res, err)
+	}
+	// the errors of the host's calls have no location
+	_, err = vm.CallGlobal("missing")
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Error() != "undefined global missing" {
+		t.Errorf("expected a runtime error, got %v", err)
+	}
+	_, err = vm.Call(Number(1))
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Error() != "attempt to call a number value" {
+		t.Errorf("expected a runtime error, got %v", err)
+	}
+	_, err = vm.CallGlobal("len")
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.File != "" || len(rerr.Traceback) != 1 {
+		t.Errorf("expected a runtime error from len, got %#v", err)
+	}
+}
+
+func TestDefineFunc(t *testing.T) {
+	type point struct {
+		X, Y  int
+		label string
+	}
+	vm := NewVM()
+	var results []Value
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+	vm.DefineFunc("add", func(a, b int) int { return a + b })
+	vm.DefineFunc("join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	vm.DefineFunc("div", func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	})
+	vm.DefineFunc("sum", func(ns []float64) (s float64) {
+		for _, n := range ns {
+			s += n
+		}
+		return
+	})
+	vm.DefineFunc("count", func(m map[string]int) int { return len(m) })
+	vm.DefineFunc("move", func(p point, dx int) (point, string) {
+		return point{X: p.X + dx, Y: p.Y}, fmt.Sprint(p)
+	})
+	vm.DefineFunc("describe", func(v interface{}) string { return fmt.Sprintf("%T", v) })
+	vm.DefineFunc("swap", func(a, b Value) (Value, Value) { return b, a })
+	vm.DefineFunc("nothing", func() {})
+
+	source := `
+	result(add(1, 2), join("-", "a", "b", "c"), join(","))
+	result(div(1, 4), sum([1, 2, 3]), count({a: 1, b: 2}))
+	p, s := move({X: 1, Y: 2}, 3)
+	result(p.X, p.Y, s)
+	result(describe(1), describe([1]), describe({}), describe(nil))
+	a, b := swap("a", 1)
+	result(a, b, nothing())
+	`
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Value{
+		Number(3), String("a-b-c"), String(""),
+		Number(0.25), Number(6), Number(2),
+		Number(4), Number(2), String("{1 2 }"),
+		String("float64"), String("[]interface {}"), String("map[string]interface {}"), String("<nil>"),
+		Number(1), String("a"), Nil{},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(expected[i], res) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	errors := []struct {
+		source, message string
+	}{
+		{"add(1)", "add expects 2 arguments, got 1"},
+		{"join()", "join expects at least 1 argument, got 0"},
+		{`add(1, "2")`, "add: argument 2: cannot use string as int"},
+		{"add(1.5, 2)", "add: argument 1: cannot use 1.5 as int"},
+		{`join(",", "a", 1)`, "join: argument 3: cannot use number as string"},
+		{`sum([1, "2"])`, "sum: argument 1: element 1: cannot use string as float64"},
+		{`move({X: "1"}, 1)`, "move: argument 1: field X: cannot use string as int"},
+		{"div(1, 0)", "division by zero"},
+	}
+	for _, e := range errors {
+		err := vm.RunString([]byte(e.source), "test")
+		if err == nil || !strings.Contains(err.Error(), e.message) {
+			t.Errorf("%s: expected error %q, got %v", e.source, e.message, err)
+		}
+	}
+	err := vm.RunString([]byte(`try { div(1, 0) } recover e { result(e) }`), "test")
+	if err != nil {
+		t.Errorf("expected the error to be recovered, got %v", err)
+	}
+}
+
+func TestConversions(t *testing.T) {
+	type Base struct {
+		ID   int
+		Kind string
+	}
+	type user struct {
+		Base
+		Name    string   `yo:"name"`
+		Tags    []string `yo:"tags"`
+		Manager *user    `yo:"manager"`
+		Secret  string   `yo:"-"`
+		Kind    string
+		age     int
+	}
+
+	boss := &user{Name: "ann"}
+	v, err := ToValue(&user{
+		Base:    Base{ID: 7, Kind: "base"},
+		Name:    "bob",
+		Tags:    []string{"a", "b"},
+		Manager: boss,
+		Secret:  "x",
+		Kind:    "admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, ok := v.(*Object)
+	if !ok {
+		t.Fatalf("expected an object, got %v", v)
+	}
+	tags := Array{String("a"), String("b")}
+	expected := map[string]Value{
+		"ID":      Number(7),
+		"name":    String("bob"),
+		"tags":    &tags,
+		"manager": NewObject(nil, map[string]Value{"ID": Number(0), "name": String("ann"), "tags": Nil{}, "manager": Nil{}, "Kind": String("")}),
+		"Kind":    String("admin"),
+	}
+	if !valuesEqual(obj, NewObject(nil, expected)) {
+		t.Errorf("expected %v, got %v", expected, obj.Fields)
+	}
+
+	// the fields left out of the object are left as they are
+	var u user
+	u.Secret = "kept"
+	obj.Set("ID", Number(8))
+	if err := ExportTo(obj, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 8 || u.Name != "bob" || len(u.Tags) != 2 || u.Manager == nil || u.Manager.Name != "ann" || u.Secret != "kept" || u.Kind != "admin" {
+		t.Errorf("unexpected %+v", u)
+	}
+
+	fn, err := ToValue(strings.ToUpper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM()
+	vm.Define("upper", fn)
+	if res, err := vm.CallGlobal("upper", String("abc")); err != nil || len(res) != 1 || res[0] != String("ABC") {
+		t.Errorf("expected [ABC], got %v, %v", res, err)
+	}
+
+	arr := Array{Number(1), String("a"), Nil{}, Bool(true)}
+	exported := NewObject(nil, map[string]Value{"arr": &arr}).Export()
+	if fmt.Sprint(exported) != "map[arr:[1 a <nil> true]]" {
+		t.Errorf("unexpected export %v", exported)
+	}
+
+	// cycles are exported as they are, but can't convert to Go types
+	self := NewObject(nil, map[string]Value{})
+	self.Set("Self", self)
+	m := self.Export().(map[string]interface{})
+	if inner, ok := m["Self"].(map[string]interface{}); !ok || inner["Self"] == nil {
+		t.Errorf("expected a cyclic map, got %v", m)
+	}
+	type node struct{ Self *node }
+	var n node
+	if err := ExportTo(self, &map[string]node{}); err == nil {
+		t.Errorf("expected an error")
+	}
+	err = ExportTo(self, &n)
+	if _, ok := err.(*CycleError); !ok {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	cyclic := &node{}
+	cyclic.Self = cyclic
+	if _, err := ToValue(cyclic); err == nil || err.Error() != "field Self: cannot convert a cyclic value" {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+
+	var ns []int
+	err = ExportTo(&Array{Number(1), String("2")}, &ns)
+	if te, ok := err.(*TypeError); !ok || te.Path != "element 1" || te.Value != String("2") {
+		t.Errorf("expected a type error, got %v", err)
+	}
+	if _, err := ToValue(map[int]string{}); err == nil || err.Error() != "cannot convert map[int]string to a value" {
+		t.Errorf("expected a type error, got %v", err)
+	}
+	if err := ExportTo(Nil{}, ns); err == nil {
+		t.Errorf("expected an error exporting to a non-pointer")
+	}
+}
+
+type testAddress struct {
+	City string `yo:"city"`
+}
+
+type testAccount struct {
+	Name    string
+	Balance float64
+	Address testAddress
+	Owner   *testAccount
+	Tags    []string
+	Limits  map[string]float64
+	History []testAddress
+	secret  string
+}
+
+func (a *testAccount) Deposit(n float64) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid amount %v", n)
+	}
+	a.Balance += n
+	return nil
+}
+
+func (a *testAccount) Greet(greeting string) string {
+	return greeting + ", " + a.Name
+}
+
+func TestWrapObject(t *testing.T) {
+	owner := &testAccount{Name: "ann"}
+	acc := &testAccount{Owner: owner, secret: "x"}
+	vm := NewVM()
+	var results []Value
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+	vm.Define("acc", vm.WrapObject(acc))
+	vm.Define("same", vm.WrapObject(acc))
+	vm.DefineFunc("ownerOf", func(a *testAccount) *testAccount { return a.Owner })
+
+	source := `
+	acc.Name = "bob"
+	acc.Deposit(10)
+	deposit := acc.Deposit
+	deposit(5)
+	acc.Address.city = "Paris"
+	acc.Owner.Balance += 1
+	result(acc.Name, acc.Balance, acc.Address.city, acc.Greet("hi"), acc.Owner.Name)
+	acc.note = "own field"
+	result(acc.note, acc.secret, acc == same, ownerOf(acc).Name)
+	try {
+		acc.Balance = "x"
+	} recover e {
+		result(e)
+	}
+	try {
+		acc.Deposit(-1)
+	} recover e {
+		result(e)
+	}
+	try {
+		acc.Greet = nil
+	} recover e {
+		result(e)
+	}
+	`
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Value{
+		String("bob"), Number(15), String("Paris"), String("hi, bob"), String("ann"),
+		String("own field"), Nil{}, Bool(true), String("ann"),
+		String("field Balance: cannot use string as float64"),
+		String("invalid amount -1"),
+		String("cannot assign to method Greet"),
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(expected[i], res) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+	if acc.Name != "bob" || acc.Balance != 15 || acc.Address.City != "Paris" || owner.Balance != 1 {
+		t.Errorf("expected the script to change the Go value, got %+v", acc)
+	}
+	if g := vm.Globals["acc"]; g.Export() != acc {
+		t.Errorf("expected the wrapped pointer, got %v", g.Export())
+	}
+}
+
+func TestWrapObjectContainers(t *testing.T) {
+	acc := &testAccount{
+		Name:    "ann",
+		Tags:    []string{"a", "b"},
+		Limits:  map[string]float64{"daily": 10},
+		History: []testAddress{{City: "Rome"}},
+	}
+	vm := NewVM()
+	var results []Value
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+	vm.Define("acc", vm.WrapObject(acc))
+
+	source := `
+	acc.Tags[0] = "changed"
+	append(acc.Tags, "c")
+	acc.Limits.daily += 5
+	acc.Limits["weekly"] = 50
+	acc.History[0].city = "Oslo"
+	result(acc.Tags[0], len(acc.Tags), acc.Limits.weekly, len(acc.Limits), acc.History[0].city)
+	tags := ""
+	for i, tag in acc.Tags {
+		tags += tag
+	}
+	result(tags, len(acc))
+	keys := ""
+	for k, v in acc {
+		keys += k + " "
+	}
+	result(keys)
+	try {
+		acc.Tags[5] = "x"
+	} recover e {
+		result(e)
+	}
+	try {
+		acc.Tags[0] = 1
+	} recover e {
+		result(e)
+	}
+	`
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Value{
+		String("changed"), Number(3), Number(50), Number(2), String("Oslo"),
+		String("changedbc"), Number(7),
+		String("Address Balance History Limits Name Owner Tags "),
+		String("slice index 5 out of range [0:3]"),
+		String("element 0: cannot use number as string"),
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(expected[i], res) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+	if acc.Tags[0] != "changed" || len(acc.Tags) != 3 || acc.Limits["daily"] != 15 || acc.Limits["weekly"] != 50 || acc.History[0].City != "Oslo" {
+		t.Errorf("expected the script to change the Go value, got %+v", acc)
+	}
+}
+
+func TestFuncCallHelpers(t *testing.T) {
+	vm := NewVM()
+	var results []Value
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+	clamp := GoFunc(func(call *FuncCall) {
+		n, ok := call.Number(0)
+		if !ok {
+			return
+		}
+		lo, ok := call.OptNumber(1, 0)
+		if !ok {
+			return
+		}
+		hi, ok := call.OptNumber(2, 1)
+		if !ok {
+			return
+		}
+		call.PushReturnValue(Number(math.Max(lo, math.Min(hi, n))))
+	})
+	vm.Define("clamp", clamp)
+	vm.Define("joinAll", GoFunc(func(call *FuncCall) {
+		if !call.Check(2) {
+			return
+		}
+		arr, ok := call.Array(0)
+		if !ok {
+			return
+		}
+		sep, ok := call.String(1)
+		if !ok {
+			return
+		}
+		parts := make([]string, len(*arr))
+		for i, v := range *arr {
+			parts[i] = v.String()
+		}
+		call.PushReturnValue(String(strings.Join(parts, sep)))
+	}))
+	vm.Define("fields", GoFunc(func(call *FuncCall) {
+		obj, ok := call.Object(0)
+		if ok {
+			call.PushReturnValue(Number(len(obj.Fields)))
+		}
+	}))
+	vm.Define("fail", GoFunc(func(call *FuncCall) {
+		call.Error("failed with %d", 42)
+	}))
+
+	source := `
+	result(clamp(2), clamp(-1, nil), clamp(5, 0, 10), joinAll([1, "a"], "-"), fields({a: 1}))
+	try {
+		fail()
+	} recover e {
+		result(e)
+	}
+	`
+	if err := vm.RunString([]byte(source), "test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Value{Number(1), Number(0), Number(5), String("1-a"), Number(1), String("failed with 42")}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, results)
+	}
+	for i, res := range results {
+		if !valuesEqual(expected[i], res) {
+			t.Errorf("(%d) expected %v, got %v", i, expected[i], res)
+		}
+	}
+
+	errors := []struct {
+		source, message string
+	}{
+		{`clamp("x")`, "clamp: argument 1: expected a number, got string"},
+		{"clamp()", "clamp: argument 1: expected a number, got no value"},
+		{`clamp(1, 0, "x")`, "clamp: argument 3: expected a number, got string"},
+		{"o := {limit: clamp}\no.limit(true)", "limit: argument 1: expected a number, got bool"},
+		{"joinAll([])", "joinAll: expected at least 2 arguments, got 1"},
+		{"joinAll({}, 1)", "joinAll: argument 1: expected an array, got object"},
+		{"joinAll([], 1)", "joinAll: argument 2: expected a string, got number"},
+		{"fields([])", "fields: argument 1: expected an object, got array"},
+		{"append(1, 2)", "append: argument 1: expected an array, got number"},
+		{`sleep("1")`, "sleep: argument 1: expected a number, got string"},
+		{"close(1)", "close: argument 1: expected a chan, got number"},
+		{"close()", "close: argument 1: expected a chan, got no value"},
+		{"len(1)", "len: argument 1: expected an array, string, object or chan, got number"},
+		{"len()", "len: argument 1: expected an array, string, object or chan, got no value"},
+		{"new()", "new: expected at least 1 argument, got 0"},
+		{"new(1)", "new: argument 1: expected an object, got number"},
+		{"new({}, [])", "new: argument 2: expected an object, got array"},
+		{"f := clamp\nf(nil)", "f: argument 1: expected a number, got nil"},
+		{"func g() {\n\tdefer len(1)\n}\ng()", "len: argument 1: expected an array, string, object or chan, got number"},
+	}
+	for _, e := range errors {
+		err := vm.RunString([]byte(e.source), "test")
+		if err == nil || !strings.Contains(err.Error(), e.message) {
+			t.Errorf("%s: expected error %q, got %v", e.source, e.message, err)
+		}
+	}
+	if _, err := vm.Call(clamp, String("x")); err == nil || !strings.Contains(err.Error(), "argument 1: expected a number, got string") {
+		t.Errorf("expected a runtime error, got %v", err)
+	}
+	if _, err := vm.CallGlobal("len", Number(1)); err == nil || !strings.Contains(err.Error(), "len: argument 1") {
+		t.Errorf("expected the builtin's name in the error, got %v", err)
+	}
+}